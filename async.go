@@ -0,0 +1,145 @@
+package rollout
+
+import (
+	"sync"
+)
+
+// asyncQueue holds writes waiting for the background goroutine in async mode.
+type asyncQueue struct {
+	mux    sync.RWMutex
+	items  chan asyncItem
+	closed bool
+	done   chan struct{}
+
+	// Callbacks due after background writes run on a goroutine of their own, so a callback writing
+	// to the Rollout never waits for the goroutine draining the queue.
+	cbMux     sync.Mutex
+	callbacks []func()
+	wake      chan struct{}
+	notified  chan struct{}
+}
+
+// asyncItem is either data to write, or a marker whose drained channel is closed once all items
+// queued before it are written.
+type asyncItem struct {
+	p       []byte
+	drained chan struct{}
+}
+
+func newAsyncQueue(size int) *asyncQueue {
+	return &asyncQueue{
+		items:    make(chan asyncItem, size),
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		notified: make(chan struct{}),
+	}
+}
+
+// push queues a copy of p. It blocks when the queue is full, and returns ErrClosed once the
+// queue is closed.
+func (q *asyncQueue) push(p []byte) (int, error) {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+	q.items <- asyncItem{p: b}
+	return len(p), nil
+}
+
+// mark queues a marker, returning its channel closed once items queued so far are written.
+func (q *asyncQueue) mark() (<-chan struct{}, error) {
+	q.mux.RLock()
+	defer q.mux.RUnlock()
+
+	if q.closed {
+		return nil, ErrClosed
+	}
+
+	drained := make(chan struct{})
+	q.items <- asyncItem{drained: drained}
+	return drained, nil
+}
+
+// close stops accepting writes. The background goroutine closes done after writing the
+// remaining items.
+func (q *asyncQueue) close() {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+}
+
+// consume writes queued data until the queue is closed and drained. Callbacks are handed over
+// to notify.
+func (r *Rollout) consume() {
+	defer close(r.queue.done)
+	defer close(r.queue.wake)
+
+	for item := range r.queue.items {
+		if item.drained != nil {
+			close(item.drained)
+			continue
+		}
+		r.mux.Lock()
+		_, err := r.write(item.p)
+		r.fail(err)
+		if callbacks := r.release(); callbacks != nil {
+			r.queue.handOff(callbacks)
+		}
+	}
+}
+
+// handOff queues callbacks for notify without blocking.
+func (q *asyncQueue) handOff(callbacks func()) {
+	q.cbMux.Lock()
+	q.callbacks = append(q.callbacks, callbacks)
+	q.cbMux.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// notify runs the callbacks handed off by consume in order, until consume is done.
+func (r *Rollout) notify() {
+	defer close(r.queue.notified)
+
+	for range r.queue.wake {
+		for {
+			r.queue.cbMux.Lock()
+			callbacks := r.queue.callbacks
+			r.queue.callbacks = nil
+			r.queue.cbMux.Unlock()
+
+			if len(callbacks) == 0 {
+				break
+			}
+			for _, f := range callbacks {
+				f()
+			}
+		}
+	}
+}
+
+// Drain blocks until data written so far is in the destination. Unlike Flush, which only writes
+// out the current buffer, it waits in async mode for queued writes to reach the buffer first. In
+// sync mode it is the same as Flush.
+func (r *Rollout) Drain() error {
+	if r.queue != nil {
+		drained, err := r.queue.mark()
+		if err != nil {
+			return err
+		}
+		<-drained
+	}
+	return r.Flush()
+}
@@ -1,12 +1,21 @@
 package rollout
 
 import (
+	"errors"
 	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Buffer interface defines buffer's common behaviors used by Rollout. A Buffer must implement
 // io.WriteCloser interface. A Flush method is used to flush data to underlying writer before
 // Rollout closes.
+//
+// Rollout never calls Write concurrently, in sync and async mode alike. A Buffer must write each p
+// contiguously, even when it spans several flushes, so concurrent Rollout writes never interleave.
+// Built-in buffers guarantee that.
 type Buffer interface {
 	io.WriteCloser
 
@@ -14,10 +23,292 @@ type Buffer interface {
 	Flush() error
 }
 
+// Sizer is optionally implemented by buffers telling the size of their destination, including
+// data still buffered. Rollout counts MaxSize from the size of a destination when it is opened, so
+// destinations of custom buffers appended to rotate in time too.
+type Sizer interface {
+	Size() int64
+}
+
+// Named is optionally implemented by buffers telling the name of their destination, such as a
+// path or an object key, returned by CurrentFile instead of the rendered destination.
+type Named interface {
+	Name() string
+}
+
+// WriterBuffer is a thread safe Buffer writing to an io.Writer supplied by user.
+type WriterBuffer struct {
+	mux sync.Mutex
+	w   *BufferWriter
+}
+
+// NewWriterBuffer returns a BufferFunc creating WriterBuffer on top of w. The dest and interval
+// are ignored, so all destinations go to w. Closing the buffer flushes data but never closes w.
+// It is handy for testing code depending on rotation.
+func NewWriterBuffer(w io.Writer) BufferFunc {
+	return func(dest string, size int, interval time.Duration) (Buffer, error) {
+		return &WriterBuffer{w: NewWriterSize(w, size)}, nil
+	}
+}
+
+// Write writes the contents of p into the buffer.
+func (b *WriterBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.w.Write(p)
+}
+
+// Flush writes buffered data to the underlying writer.
+func (b *WriterBuffer) Flush() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.w.Flush()
+}
+
+// Buffered returns the number of bytes held in the buffer.
+func (b *WriterBuffer) Buffered() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.w.Buffered()
+}
+
+// Available returns how many bytes are unused in the buffer.
+func (b *WriterBuffer) Available() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.w.Available()
+}
+
+// Close flushes buffered data. The underlying writer is left open.
+func (b *WriterBuffer) Close() error {
+	return b.Flush()
+}
+
+// DiscardBuffer is a Buffer discarding all data written to it.
+type DiscardBuffer struct{}
+
+// NewDiscardBuffer is a BufferFunc creating DiscardBuffer. Together with Reconfigure, it turns
+// logging off at runtime without nil checks.
+func NewDiscardBuffer(dest string, size int, interval time.Duration) (Buffer, error) {
+	return DiscardBuffer{}, nil
+}
+
+// Write discards p and always succeeds.
+func (DiscardBuffer) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// Flush does nothing.
+func (DiscardBuffer) Flush() error {
+	return nil
+}
+
+// Close does nothing.
+func (DiscardBuffer) Close() error {
+	return nil
+}
+
+// multiBuffer fans out to several buffers.
+type multiBuffer []Buffer
+
+// MultiBuffer returns a BufferFunc creating a buffer of each of funcs for every destination, like
+// a tee. Write, Flush and Close go to all of them, errors are joined. If one fails to open, the
+// ones already opened are closed.
+func MultiBuffer(funcs ...BufferFunc) BufferFunc {
+	return func(dest string, size int, interval time.Duration) (Buffer, error) {
+		bufs := make(multiBuffer, 0, len(funcs))
+		for _, f := range funcs {
+			b, err := f(dest, size, interval)
+			if err != nil {
+				bufs.Close()
+				return nil, err
+			}
+			bufs = append(bufs, b)
+		}
+		return bufs, nil
+	}
+}
+
+// Write writes p to all buffers. It reports p written in full only if every buffer accepted it.
+func (m multiBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	var errs []error
+	for _, b := range m {
+		written, err := b.Write(p)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if written < n {
+			n = written
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// Flush flushes all buffers.
+func (m multiBuffer) Flush() error {
+	var errs []error
+	for _, b := range m {
+		if err := b.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync syncs all buffers, flushing those unable to sync.
+func (m multiBuffer) Sync() error {
+	var errs []error
+	for _, b := range m {
+		if err := syncBuffer(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes all buffers.
+func (m multiBuffer) Close() error {
+	var errs []error
+	for _, b := range m {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// routingBuffer sends each write to a child buffer chosen by its content.
+type routingBuffer struct {
+	mux      sync.Mutex
+	classify func(p []byte) string
+	open     BufferFunc
+	dest     string
+	size     int
+	interval time.Duration
+	bufs     map[string]Buffer
+}
+
+// RoutingBuffer returns a BufferFunc splitting every destination into several buffers of f, one
+// per sub-name returned by classify for each write. The sub-name goes before the extension of
+// the destination, so "error" routes writes of app.log to app.error.log. An empty sub-name
+// routes to the destination itself. Children are opened on their first write and rotate along
+// with the destination. For example, classify may look at the level prefix of a line.
+func RoutingBuffer(classify func(p []byte) string, f BufferFunc) BufferFunc {
+	return func(dest string, size int, interval time.Duration) (Buffer, error) {
+		return &routingBuffer{
+			classify: classify,
+			open:     f,
+			dest:     dest,
+			size:     size,
+			interval: interval,
+			bufs:     make(map[string]Buffer),
+		}, nil
+	}
+}
+
+// routeDest inserts name before the extension of dest.
+func routeDest(dest, name string) string {
+	if name == "" {
+		return dest
+	}
+	ext := filepath.Ext(dest)
+	return strings.TrimSuffix(dest, ext) + "." + name + ext
+}
+
+// Write writes p to the child buffer of its sub-name, opening it if needed.
+func (m *routingBuffer) Write(p []byte) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	name := m.classify(p)
+	b, ok := m.bufs[name]
+	if !ok {
+		var err error
+		b, err = m.open(routeDest(m.dest, name), m.size, m.interval)
+		if err != nil {
+			return 0, err
+		}
+		m.bufs[name] = b
+	}
+	return b.Write(p)
+}
+
+// Flush flushes all child buffers.
+func (m *routingBuffer) Flush() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var errs []error
+	for _, b := range m.bufs {
+		if err := b.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Sync syncs all child buffers, flushing those unable to sync.
+func (m *routingBuffer) Sync() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var errs []error
+	for _, b := range m.bufs {
+		if err := syncBuffer(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes all child buffers.
+func (m *routingBuffer) Close() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var errs []error
+	for name, b := range m.bufs {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(m.bufs, name)
+	}
+	return errors.Join(errs...)
+}
+
+// bufferPools maps buffer sizes to pools of byte slices of the size, reused by buffers of
+// destinations rotated in.
+var bufferPools sync.Map
+
+// getBuffer returns a byte slice of size, reusing a released one when possible.
+func getBuffer(size int) []byte {
+	p, ok := bufferPools.Load(size)
+	if !ok {
+		p, _ = bufferPools.LoadOrStore(size, &sync.Pool{})
+	}
+	if buf, ok := p.(*sync.Pool).Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, size)
+}
+
+// putBuffer releases buf for reuse by getBuffer.
+func putBuffer(buf []byte) {
+	if p, ok := bufferPools.Load(len(buf)); ok {
+		p.(*sync.Pool).Put(&buf)
+	}
+}
+
 type BufferWriter struct {
 	err error
 	buf []byte
 	n   int
+	max int
 	wr  io.Writer
 }
 
@@ -34,11 +325,49 @@ func NewWriterSize(w io.Writer, size int) *BufferWriter {
 		size = defaultBufferSize
 	}
 	return &BufferWriter{
-		buf: make([]byte, size),
+		buf: getBuffer(size),
 		wr:  w,
 	}
 }
 
+// NewWriterSizeMax returns a new Writer like NewWriterSize, whose buffer grows up to max for
+// writes larger than the space left, instead of writing them directly. A max not larger than the
+// buffer keeps it fixed.
+func NewWriterSizeMax(w io.Writer, size, max int) *BufferWriter {
+	b := NewWriterSize(w, size)
+	b.max = max
+	return b
+}
+
+// grow enlarges the buffer, doubling its size up to max, so n more bytes fit in it. It does
+// nothing if they don't fit even at max, or the buffer was released.
+func (b *BufferWriter) grow(n int) {
+	need := b.n + n
+	if b.buf == nil || need > b.max {
+		return
+	}
+	size := len(b.buf)
+	for size < need {
+		size *= 2
+	}
+	if size > b.max {
+		size = b.max
+	}
+	buf := make([]byte, size)
+	copy(buf, b.buf[:b.n])
+	putBuffer(b.buf)
+	b.buf = buf
+}
+
+// release gives the buffer back for reuse when no data is pending in it. Later writes go to the
+// underlying io.Writer directly.
+func (b *BufferWriter) release() {
+	if b.n == 0 && b.buf != nil {
+		putBuffer(b.buf)
+		b.buf = nil
+	}
+}
+
 // Flush writes any buffered data to the underlying io.Writer.
 func (b *BufferWriter) Flush() error {
 	if b.err != nil {
@@ -74,19 +403,33 @@ func (b *BufferWriter) Buffered() int { return b.n }
 // If nn < len(p), it also returns an error explaining
 // why the write is short.
 func (b *BufferWriter) Write(p []byte) (nn int, err error) {
+	if len(p) > b.Available() && b.err == nil {
+		b.grow(len(p))
+	}
 	if len(p) > b.Available() && b.err == nil {
 		var n int
 		if b.Buffered() == 0 {
 			// Large write, empty buffer.
 			// Write directly from p to avoid copy.
 			nn, b.err = b.wr.Write(p)
+			if nn < len(p) && b.err == nil {
+				b.err = io.ErrShortWrite
+			}
 		} else {
-			for len(p) > 0 {
+			// Stop as soon as flushing fails, the buffer can't drain anymore.
+			for len(p) > 0 && b.err == nil {
 				n = copy(b.buf[b.n:], p)
 				b.n += n
-				b.Flush()
 				nn += n
 				p = p[n:]
+				if b.Flush() != nil {
+					// The unflushed tail of the buffer may hold part of the last copy, which
+					// never reached the underlying writer.
+					if b.n < n {
+						n = b.n
+					}
+					nn -= n
+				}
 			}
 		}
 		if b.err != nil {
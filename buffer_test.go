@@ -0,0 +1,257 @@
+package rollout
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		BufferFunc: NewWriterBuffer(buf),
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	r.Write([]byte("day 5\n"))
+	assert.Zero(t, buf.Len(), "data should be buffered")
+
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+	assert.Equal(t, "day 5\n", buf.String(), "rotation should flush the old buffer")
+
+	r.Close()
+	assert.Equal(t, "day 5\nday 6\n", buf.String(), "close should flush data")
+}
+
+func TestDiscardBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := New(Options{BufferFunc: NewWriterBuffer(buf), Template: "test.log"})
+
+	r.Write([]byte("on\n"))
+	assert.NoError(t, r.Reconfigure(Options{Template: "discard.log", BufferFunc: NewDiscardBuffer}))
+
+	n, err := r.Write([]byte("off\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n, "discarded data should be reported written")
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "on\n", buf.String(), "data should be discarded")
+}
+
+func TestMultiBuffer(t *testing.T) {
+	a, b := new(bytes.Buffer), new(bytes.Buffer)
+	r := New(Options{BufferFunc: MultiBuffer(NewWriterBuffer(a), NewWriterBuffer(b))})
+	r.Write([]byte("tee\n"))
+	assert.NoError(t, r.Flush())
+	assert.Equal(t, "tee\n", a.String(), "first buffer should get data")
+	assert.Equal(t, "tee\n", b.String(), "second buffer should get data")
+	assert.NoError(t, r.Close())
+
+	w := &shortWriter{limit: 2, err: io.ErrShortWrite}
+	buf, _ := MultiBuffer(NewWriterBuffer(a), NewWriterBuffer(w))("test.log", 1, 0)
+	n, err := buf.Write([]byte("1234"))
+	assert.True(t, errors.Is(err, io.ErrShortWrite), "errors should be aggregated")
+	assert.Equal(t, 2, n, "shortest write should be reported")
+
+	opened := &MockBuffer{}
+	failure := errors.New("open")
+	_, err = MultiBuffer(
+		func(dest string, size int, interval time.Duration) (Buffer, error) { return opened, nil },
+		func(dest string, size int, interval time.Duration) (Buffer, error) { return nil, failure },
+	)("test.log", 1, 0)
+	assert.Equal(t, failure, err, "open error should be returned")
+	opened.AssertCalled(t, "Close")
+}
+
+func TestRoutingBuffer(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "app.log",
+		BufferFunc: RoutingBuffer(func(p []byte) string {
+			if bytes.HasPrefix(p, []byte("ERROR")) {
+				return "error"
+			}
+			return ""
+		}, NewFileBuffer),
+	})
+	r.Write([]byte("INFO started\n"))
+	r.Write([]byte("ERROR failed\n"))
+	assert.NoError(t, r.Close())
+
+	content, _ := os.ReadFile(filepath.Join(root, "app.log"))
+	assert.Equal(t, "INFO started\n", string(content), "unclassified writes should go to destination")
+	content, _ = os.ReadFile(filepath.Join(root, "app.error.log"))
+	assert.Equal(t, "ERROR failed\n", string(content), "classified writes should go to sub destination")
+
+	assert.Equal(t, "dir/app", routeDest("dir/app", ""), "empty sub-name should keep destination")
+	assert.Equal(t, "dir/app.error", routeDest("dir/app", "error"), "sub-name should be appended without extension")
+}
+
+func TestBufferWriterGrow(t *testing.T) {
+	w := &countingWriter{}
+	b := NewWriterSizeMax(w, 4, 16)
+
+	b.Write([]byte("123"))
+	b.Write([]byte("4567890"))
+	assert.Zero(t, w.writes, "buffer should grow instead of writing")
+	assert.Equal(t, 16, b.Available()+b.Buffered(), "buffer should double up to max")
+
+	b.Write([]byte("12345678901234567"))
+	assert.Equal(t, 10+17, w.Len(), "writes beyond max should be written")
+
+	fixed := NewWriterSize(&countingWriter{}, 4)
+	fixed.Write([]byte("12345"))
+	assert.Equal(t, 4, len(fixed.buf), "buffer should be fixed by default")
+}
+
+// countingWriter counts calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestFramedBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := New(Options{BufferSize: 8, BufferFunc: FramedBuffer(NewWriterBuffer(buf))})
+
+	records := []string{"a", "", strings.Repeat("b", 300), "c"}
+	for _, rec := range records {
+		n, err := r.Write([]byte(rec))
+		assert.NoError(t, err)
+		assert.Equal(t, len(rec), n, "length prefix should not be counted")
+	}
+	assert.NoError(t, r.Close())
+
+	fr := NewFrameReader(bytes.NewReader(buf.Bytes()), 0)
+	for _, rec := range records {
+		got, err := fr.Next()
+		assert.NoError(t, err)
+		assert.Equal(t, rec, string(got), "records should be read back")
+	}
+	_, err := fr.Next()
+	assert.Equal(t, io.EOF, err, "reading past the last record should return EOF")
+
+	fr = NewFrameReader(bytes.NewReader(buf.Bytes()[:5]), 0)
+	fr.Next()
+	fr.Next()
+	_, err = fr.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "truncated record should be reported")
+
+	fr = NewFrameReader(bytes.NewReader(buf.Bytes()), 100)
+	fr.Next()
+	fr.Next()
+	_, err = fr.Next()
+	assert.Equal(t, ErrFrameTooLarge, err, "records over the limit should be rejected")
+}
+
+// shortWriter accepts at most limit bytes in total, then fails every write.
+type shortWriter struct {
+	bytes.Buffer
+	limit int
+	err   error
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) <= w.limit {
+		return w.Buffer.Write(p)
+	}
+	n, _ := w.Buffer.Write(p[:w.limit-w.Len()])
+	return n, w.err
+}
+
+func TestBufferWriterShortWrite(t *testing.T) {
+	w := &shortWriter{limit: 3, err: io.ErrShortWrite}
+	b := NewWriterSize(w, 4)
+	n, err := b.Write([]byte("1234567890"))
+	assert.Equal(t, io.ErrShortWrite, err, "direct write should return error")
+	assert.Equal(t, 3, n, "only written bytes should be counted")
+
+	w = &shortWriter{limit: 3}
+	b = NewWriterSize(w, 4)
+	n, err = b.Write([]byte("1234567890"))
+	assert.Equal(t, io.ErrShortWrite, err, "short write without error should return io.ErrShortWrite")
+	assert.Equal(t, 3, n, "only written bytes should be counted")
+
+	w = &shortWriter{limit: 3, err: io.ErrShortWrite}
+	b = NewWriterSize(w, 10)
+	b.Write([]byte("12345"))
+	n, err = b.Write([]byte("abcdefghijklmnopqrst"))
+	assert.Equal(t, io.ErrShortWrite, err, "failed flush should stop the write")
+	assert.Equal(t, 0, n, "bytes left in the buffer should not be counted")
+}
+
+// flakyWriter accepts the first write, then writes half of the next one and fails.
+type flakyWriter struct {
+	bytes.Buffer
+	calls int
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if w.calls == 1 {
+		return w.Buffer.Write(p)
+	}
+	n, _ := w.Buffer.Write(p[:len(p)/2])
+	return n, io.ErrUnexpectedEOF
+}
+
+func TestBufferWriterSecondFlushFailure(t *testing.T) {
+	w := &flakyWriter{}
+	b := NewWriterSize(w, 4)
+	b.Write([]byte("ab"))
+
+	n, err := b.Write([]byte("cdefghij"))
+	assert.Equal(t, io.ErrUnexpectedEOF, err, "failed flush should stop the write")
+	assert.Equal(t, "abcdef", w.String(), "write should stop at the failed flush")
+	assert.Equal(t, 4, n, "only bytes reaching the writer should be counted")
+	assert.Equal(t, 2, w.calls, "nothing should be written after the failure")
+}
+
+func TestRolloutShortWrite(t *testing.T) {
+	w := &shortWriter{limit: 3, err: io.ErrShortWrite}
+	r := New(Options{
+		BufferFunc: NewWriterBuffer(w),
+		BufferSize: 4,
+	})
+
+	p := []byte("1234567890")
+	n, err := r.Write(p)
+	assert.Equal(t, io.ErrShortWrite, err, "write should return error")
+	assert.Equal(t, 3, n, "n should count consumed bytes")
+	assert.Equal(t, int64(3), r.Stats().BytesWritten, "stats should count consumed bytes")
+}
+
+func TestRolloutEnsureNewline(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := New(Options{
+		BufferFunc:    NewWriterBuffer(buf),
+		BufferSize:    4,
+		EnsureNewline: true,
+	})
+
+	for _, p := range []string{"line 1", "line 2\n", "", "a longer line 3"} {
+		n, err := r.Write([]byte(p))
+		assert.NoError(t, err)
+		assert.Equal(t, len(p), n, "n should not count the appended newline")
+	}
+	r.Close()
+
+	assert.Equal(t, "line 1\nline 2\na longer line 3\n", buf.String(), "every write should end with a newline")
+}
@@ -0,0 +1,75 @@
+package rollout
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+const defaultCompressSuffix = ".gz"
+
+// gzipCompressor returns a compressor writing gzip at level.
+func gzipCompressor(level int) func(dst io.Writer) (io.WriteCloser, error) {
+	return func(dst io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(dst, level)
+	}
+}
+
+// compressFile compresses the file at name into name+suffix with compressor and removes the
+// original. An existing archive is kept, with the file appended as another member, which gzip
+// and zstd readers decompress as a concatenation. The archive is written to a temporary file
+// first, so a failure never leaves a partial archive behind.
+func compressFile(name, suffix string, compressor func(dst io.Writer) (io.WriteCloser, error)) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := name + suffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if prev, err := os.Open(name + suffix); err == nil {
+		_, err = io.Copy(dst, prev)
+		prev.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	zw, err := compressor(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(zw, src); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, name+suffix); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,91 @@
+package rollout
+
+import (
+	"time"
+)
+
+const (
+	// rotationEventsSize is the capacity of the channel returned by RotationEvents.
+	rotationEventsSize = 16
+
+	// errorsSize is the capacity of the channel returned by Errors.
+	errorsSize = 16
+)
+
+// RotationEvent describes a rotation from one destination to the next.
+type RotationEvent struct {
+	// Old is the destination rotated out.
+	Old string
+
+	// New is the destination written from now on.
+	New string
+
+	// Time is when the rotation happened.
+	Time time.Time
+
+	// Pending is set when the rotation is due under ManualRotate, and happens on RotateNow. New is
+	// the destination RotateNow would open at Time.
+	Pending bool
+}
+
+// RotationEvents returns a channel receiving an event on every rotation. Events are dropped when
+// the channel is full, so a slow receiver never stalls Write. The channel is closed once Rollout
+// is closed. All calls return the same channel.
+func (r *Rollout) RotationEvents() <-chan RotationEvent {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.events == nil {
+		r.events = make(chan RotationEvent, rotationEventsSize)
+	}
+	return r.events
+}
+
+// emit sends e to the RotationEvents channel without blocking. The caller must hold the write lock.
+func (r *Rollout) emit(e RotationEvent) {
+	if r.events == nil {
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+	}
+}
+
+// due reports once that a rotation to position pos is due under ManualRotate. The caller must
+// hold the write lock.
+func (r *Rollout) due(now time.Time, pos int64) {
+	if r.duePos == pos {
+		return
+	}
+	r.duePos = pos
+	dest, err := r.periodDestination(now)
+	if err != nil {
+		return
+	}
+	r.emit(RotationEvent{Old: r.buf.dest, New: dest, Time: now, Pending: true})
+}
+
+// closeEvents closes the RotationEvents channel. The caller must hold the write lock, and no
+// writes may follow.
+func (r *Rollout) closeEvents() {
+	if r.events == nil {
+		r.events = make(chan RotationEvent)
+	}
+	close(r.events)
+}
+
+// Errors returns a channel receiving the errors passed to OnError, such as failures of interval
+// flushing, to react to them programmatically. Errors are dropped when the channel is full, so
+// a receiver is free to stop consuming. The channel is never closed, as background work may
+// still fail after Close.
+func (r *Rollout) Errors() <-chan error {
+	return r.errCh
+}
+
+// Closing returns a channel closed when Close begins, before the Rollout is marked closed, so
+// background producers can hand over their final writes and stop logging instead of running into
+// ErrClosed. Close waits CloseGrace for them, writes coming later fail with ErrClosed.
+func (r *Rollout) Closing() <-chan struct{} {
+	return r.closing
+}
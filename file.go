@@ -1,7 +1,9 @@
 package rollout
 
 import (
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -9,78 +11,356 @@ import (
 // FileBuffer is a thread safe file writer with buffer. It is used to reduce disk IO.
 // Guarantee atomic in single process writing situation.
 type FileBuffer struct {
-	f     *os.File
-	timer *time.Timer
+	f           *os.File
+	name        string
+	done        chan struct{}
+	onError     func(error)
+	onFlush     func()
+	sync        bool
+	syncOnClose bool
+	fresh       bool
+	scheduler   *flushScheduler
+	borrowed    bool
 
-	mux sync.RWMutex
-	w   *BufferWriter
+	mux    sync.RWMutex
+	w      *BufferWriter
+	size   int64
+	closed bool
 }
 
-// NewFileBuffer creates a new FileBuffer instance.
+// fileOptions are settings of the built-in file buffer which BufferFunc can't carry.
+type fileOptions struct {
+	mode        os.FileMode
+	dirMode     os.FileMode
+	onError     func(error)
+	onFlush     func()
+	sync        bool
+	syncOnClose bool
+	ticker      TickerFunc
+	lock        bool
+	sharedFlush bool
+	maxBuffer   int
+	borrowed    bool
+	jitter      time.Duration
+}
+
+// NewFileBuffer creates a new FileBuffer instance. Missing parent directories of dest are created.
 func NewFileBuffer(dest string, size int, interval time.Duration) (Buffer, error) {
-	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	b, err := newFileBuffer(dest, size, interval, fileOptions{
+		mode:    defaultFileMode,
+		dirMode: defaultDirMode,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newFileBuffer(dest string, size int, interval time.Duration, o fileOptions) (*FileBuffer, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), o.dirMode); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, o.mode)
+	if err != nil {
+		return nil, err
+	}
+	if o.lock {
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, &os.PathError{Op: "lock", Path: dest, Err: err}
+		}
+	}
+	b, err := wrapFile(f, size, interval, o)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewFileBufferFromFile creates a FileBuffer writing to f, opened by the caller with the flags
+// and mode it needs, or inherited. The buffer owns f and closes it on Close.
+func NewFileBufferFromFile(f *os.File, size int, interval time.Duration) (Buffer, error) {
+	b, err := wrapFile(f, size, interval, fileOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewFileBufferBorrowing creates a FileBuffer writing to f like NewFileBufferFromFile, but Close
+// leaves f open, for files the caller keeps using, such as os.Stderr.
+func NewFileBufferBorrowing(f *os.File, size int, interval time.Duration) (Buffer, error) {
+	b, err := wrapFile(f, size, interval, fileOptions{borrowed: true})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// wrapFile creates a FileBuffer writing to the open file f.
+func wrapFile(f *os.File, size int, interval time.Duration, o fileOptions) (*FileBuffer, error) {
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
 	b := FileBuffer{
-		w: NewWriterSize(f, size),
-		f: f,
+		w:           NewWriterSizeMax(f, size, o.maxBuffer),
+		f:           f,
+		name:        f.Name(),
+		onError:     o.onError,
+		onFlush:     o.onFlush,
+		sync:        o.sync,
+		syncOnClose: o.syncOnClose,
+		borrowed:    o.borrowed,
+		fresh:       info.Size() == 0,
+		size:        info.Size(),
 	}
 
-	b.flushAtInterval(interval)
+	if o.sharedFlush && interval > 0 {
+		b.scheduler = sharedScheduler(interval, &b)
+	} else {
+		b.flushAtInterval(interval, o.ticker, o.jitter)
+	}
 
 	return &b, nil
 }
 
+// Buffered returns the number of bytes held in the buffer.
+func (b *FileBuffer) Buffered() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	return b.w.Buffered()
+}
+
+// Available returns how many bytes are unused in the buffer.
+func (b *FileBuffer) Available() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	return b.w.Available()
+}
+
+// Fresh reports whether the file was empty when it was opened, as opposed to being appended to.
+func (b *FileBuffer) Fresh() bool {
+	return b.fresh
+}
+
+// Size returns the size of the file when it was opened plus the bytes written since, buffered
+// or not. Writes by other processes aren't counted.
+func (b *FileBuffer) Size() int64 {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	return b.size
+}
+
+// Name returns the name of the file, as opened. It stays available after Close.
+func (b *FileBuffer) Name() string {
+	return b.name
+}
+
+// is reports whether other describes the open file.
+func (b *FileBuffer) is(other os.FileInfo) bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	if b.f == nil {
+		return false
+	}
+	info, err := b.f.Stat()
+	return err == nil && os.SameFile(info, other)
+}
+
 // Write writes contents of p into the buffer.
 func (b *FileBuffer) Write(p []byte) (int, error) {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	return b.w.Write(p)
+	n, err := b.w.Write(p)
+	b.size += int64(n)
+	return n, err
 }
 
-// Flush writes buffered data to file.
+// Flush writes buffered data to file. With sync enabled, the file is synced to disk as well.
 func (b *FileBuffer) Flush() error {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	return b.w.Flush()
+	return b.flush()
 }
 
-// Close stops timer, flushes data, and closes the file.
+// Sync writes buffered data to file and commits it to disk, whether sync is enabled or not.
+func (b *FileBuffer) Sync() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if err := b.w.Flush(); err != nil {
+		return err
+	}
+	if b.f == nil {
+		return nil
+	}
+	return b.f.Sync()
+}
+
+// flush does the work of Flush. The caller must hold the lock.
+func (b *FileBuffer) flush() error {
+	if err := b.w.Flush(); err != nil {
+		return err
+	}
+	if b.sync && b.f != nil {
+		return b.f.Sync()
+	}
+	return nil
+}
+
+// removeIfEmpty removes the file at dest if it is still the file of the buffer and nothing was
+// written to it, by this process or others. It reports whether the file was removed.
+func (b *FileBuffer) removeIfEmpty(dest string) (bool, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.f == nil || b.w.Buffered() > 0 {
+		return false, nil
+	}
+	info, err := b.f.Stat()
+	if err != nil || info.Size() > 0 {
+		return false, err
+	}
+	current, err := os.Stat(dest)
+	if err != nil || !os.SameFile(info, current) {
+		return false, nil
+	}
+	return true, os.Remove(dest)
+}
+
+// Close stops interval flushing, flushes data, and closes the file. Closing again does nothing.
+// With sync or sync on close enabled, the file is synced to disk before closing. A borrowed file
+// is left open.
 func (b *FileBuffer) Close() error {
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	if b.timer != nil {
-		b.timer.Stop()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+	if b.scheduler != nil {
+		b.scheduler.remove(b)
+		b.scheduler = nil
 	}
 
 	if b.f != nil {
-		b.w.Flush()
-		return b.f.Close()
+		err := b.w.Flush()
+		if err == nil {
+			b.w.release()
+		}
+		if err == nil && (b.sync || b.syncOnClose) {
+			err = b.f.Sync()
+		}
+		if b.borrowed {
+			b.f = nil
+			return err
+		}
+		if cerr := b.f.Close(); err == nil {
+			err = cerr
+		}
+		b.f = nil
+		return err
 	}
 
 	return nil
 }
 
-// flushAtInterval starts a timer, it will call Flush method every interval.
-func (b *FileBuffer) flushAtInterval(interval time.Duration) {
+// flushAtInterval starts a goroutine calling Flush every interval, until the buffer is closed.
+// With jitter, the ticker starts after a random delay up to jitter, so buffers opened at the same
+// time don't all flush at the same time.
+func (b *FileBuffer) flushAtInterval(interval time.Duration, newTicker TickerFunc, jitter time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
 	b.mux.Lock()
 	defer b.mux.Unlock()
 
-	b.timer = time.AfterFunc(interval, func() {
-		var flush bool
+	done := make(chan struct{})
+	b.done = done
 
-		b.mux.RLock()
-		flush = b.w.Buffered() > 0
-		b.mux.RUnlock()
+	if newTicker == nil {
+		newTicker = newTimeTicker
+	}
+	if jitter <= 0 {
+		go flushTicks(b, newTicker(interval), done)
+		return
+	}
 
-		if flush {
-			b.Flush()
+	delay := time.Duration(rand.Int63n(int64(jitter)))
+	go func() {
+		timer := time.NewTimer(delay)
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
 		}
-		b.flushAtInterval(interval)
-	})
+		flushTicks(b, newTicker(interval), done)
+	}()
+}
+
+// flushTicks flushes b on every tick of ticker until done is closed.
+func flushTicks(b *FileBuffer, ticker Ticker, done <-chan struct{}) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.Chan():
+			b.flushBuffered()
+		}
+	}
+}
+
+// flushBuffered flushes the buffer if there is any data in it, reporting failures to onError and
+// successful flushes to onFlush. A tick racing with Close finds the buffer closed and does nothing.
+func (b *FileBuffer) flushBuffered() {
+	b.mux.Lock()
+	var err error
+	flushed := false
+	if !b.closed && b.w.Buffered() > 0 {
+		if err = b.flush(); err != nil {
+			err = &os.PathError{Op: "flush", Path: b.f.Name(), Err: err}
+		} else {
+			flushed = true
+		}
+	}
+	b.mux.Unlock()
+
+	if err != nil && b.onError != nil {
+		b.onError(err)
+	}
+	if flushed && b.onFlush != nil {
+		b.onFlush()
+	}
+}
+
+// symlink points link at target, replacing any existing link. The target is made relative to
+// the link's directory when possible, so the link survives moving the whole directory.
+func symlink(target, link string) error {
+	if rel, err := filepath.Rel(filepath.Dir(link), target); err == nil {
+		target = rel
+	}
+
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, link)
 }
@@ -2,7 +2,12 @@ package rollout
 
 import (
 	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +40,318 @@ func TestFileBufferFlush(t *testing.T) {
 
 	assert.Equal(t, 9, buf.Len(), "data should be write to writer after flushing")
 }
+
+func TestFileBufferFlushError(t *testing.T) {
+	errs := make(chan error, 1)
+	b, err := newFileBuffer(filepath.Join(t.TempDir(), "test.log"), 10, 10*time.Millisecond, fileOptions{
+		onError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	assert.NoError(t, err)
+	defer b.Close()
+
+	b.Write([]byte("123"))
+	b.f.Close()
+
+	select {
+	case err := <-errs:
+		var perr *os.PathError
+		assert.True(t, errors.As(err, &perr), "error should carry the destination")
+		assert.Equal(t, "flush", perr.Op, "error should come from flushing")
+	case <-time.After(time.Second):
+		t.Fatal("interval flushing error should be reported")
+	}
+}
+
+func TestFileBufferFlushAtInterval(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	b, err := newFileBuffer(name, 10, 10*time.Millisecond, fileOptions{mode: defaultFileMode, dirMode: defaultDirMode})
+	assert.NoError(t, err)
+
+	b.Write([]byte("123"))
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(name)
+		return string(content) == "123"
+	}, time.Second, 5*time.Millisecond, "buffered data should be flushed at interval")
+
+	done := b.done
+	assert.NoError(t, b.Close())
+	assert.Nil(t, b.done, "close should stop interval flushing")
+	_, open := <-done
+	assert.False(t, open, "flushing goroutine should be signaled")
+}
+
+func TestFileBufferCloseAtInterval(t *testing.T) {
+	root := t.TempDir()
+	var errs []error
+	var mux sync.Mutex
+
+	for i := 0; i < 50; i++ {
+		b, err := newFileBuffer(filepath.Join(root, "test.log"), 10, time.Millisecond, fileOptions{
+			mode:    defaultFileMode,
+			dirMode: defaultDirMode,
+			onError: func(err error) {
+				mux.Lock()
+				errs = append(errs, err)
+				mux.Unlock()
+			},
+		})
+		assert.NoError(t, err)
+
+		b.Write([]byte("123"))
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, b.Close())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Empty(t, errs, "closed buffer should never be flushed at interval")
+}
+
+func TestFileBufferSharedFlush(t *testing.T) {
+	dir := t.TempDir()
+	o := fileOptions{mode: defaultFileMode, dirMode: defaultDirMode, sharedFlush: true}
+	interval := 7 * time.Millisecond
+
+	a, err := newFileBuffer(filepath.Join(dir, "a.log"), 10, interval, o)
+	assert.NoError(t, err)
+	b, err := newFileBuffer(filepath.Join(dir, "b.log"), 10, interval, o)
+	assert.NoError(t, err)
+	assert.Same(t, a.scheduler, b.scheduler, "buffers of one interval should share a scheduler")
+	assert.Nil(t, a.done, "shared buffers should not flush on their own")
+
+	a.Write([]byte("123"))
+	b.Write([]byte("456"))
+	assert.Eventually(t, func() bool {
+		ca, _ := os.ReadFile(filepath.Join(dir, "a.log"))
+		cb, _ := os.ReadFile(filepath.Join(dir, "b.log"))
+		return string(ca) == "123" && string(cb) == "456"
+	}, time.Second, 5*time.Millisecond, "scheduler should flush all buffers")
+
+	s := a.scheduler
+	assert.NoError(t, a.Close())
+	assert.NoError(t, b.Close())
+	_, open := <-s.done
+	assert.False(t, open, "scheduler should stop without buffers")
+	schedulers.mux.Lock()
+	assert.NotContains(t, schedulers.m, interval, "stopped scheduler should be removed")
+	schedulers.mux.Unlock()
+}
+
+func TestFileBufferSync(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	b, err := newFileBuffer(name, 10, time.Hour, fileOptions{mode: defaultFileMode, dirMode: defaultDirMode, sync: true})
+	assert.NoError(t, err)
+
+	b.Write([]byte("123"))
+	assert.NoError(t, b.Flush(), "flush should sync")
+
+	b.f.Close()
+	b.Write([]byte("123"))
+	err = b.Flush()
+	assert.Error(t, err, "flush should fail on closed file")
+
+	b, err = newFileBuffer(name, 10, time.Hour, fileOptions{mode: defaultFileMode, dirMode: defaultDirMode, syncOnClose: true})
+	assert.NoError(t, err)
+	b.Write([]byte("456"))
+	assert.NoError(t, b.Close(), "close should sync")
+
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "123456", string(content), "data should be written")
+}
+
+func TestFileBufferSyncMethod(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	b, err := newFileBuffer(name, 10, time.Hour, fileOptions{mode: defaultFileMode, dirMode: defaultDirMode})
+	assert.NoError(t, err)
+
+	b.Write([]byte("123"))
+	assert.NoError(t, b.Sync())
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "123", string(content), "data should be flushed")
+
+	b.f.Close()
+	assert.Error(t, b.Sync(), "sync should fail on closed file")
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {}
+
+func TestFileBufferTicker(t *testing.T) {
+	ticker := &fakeTicker{c: make(chan time.Time)}
+	name := filepath.Join(t.TempDir(), "test.log")
+	b, err := newFileBuffer(name, 10, time.Minute, fileOptions{
+		mode:    defaultFileMode,
+		dirMode: defaultDirMode,
+		ticker: func(d time.Duration) Ticker {
+			ticker.interval = d
+			return ticker
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, ticker.interval, "ticker should tick at flush interval")
+
+	b.Write([]byte("123"))
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "", string(content), "data should be buffered")
+
+	// The second tick is received only after the first flush is done.
+	ticker.c <- time.Now()
+	ticker.c <- time.Now()
+	content, _ = os.ReadFile(name)
+	assert.Equal(t, "123", string(content), "data should be flushed on tick")
+
+	b.Close()
+}
+
+func TestFileBufferFlushJitter(t *testing.T) {
+	ticker := &fakeTicker{c: make(chan time.Time)}
+	started := make(chan time.Time, 1)
+	name := filepath.Join(t.TempDir(), "test.log")
+	opened := time.Now()
+	b, err := newFileBuffer(name, 10, time.Minute, fileOptions{
+		mode:    defaultFileMode,
+		dirMode: defaultDirMode,
+		jitter:  50 * time.Millisecond,
+		ticker: func(d time.Duration) Ticker {
+			started <- time.Now()
+			return ticker
+		},
+	})
+	assert.NoError(t, err)
+
+	select {
+	case at := <-started:
+		assert.True(t, at.Sub(opened) < time.Second, "ticker should start within the jitter")
+	case <-time.After(time.Second):
+		t.Fatal("ticker should start after the jitter")
+	}
+
+	b.Write([]byte("123"))
+	ticker.c <- time.Now()
+	ticker.c <- time.Now()
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "123", string(content), "data should be flushed on tick")
+
+	b.Close()
+}
+
+func TestFileBufferReleaseBuffer(t *testing.T) {
+	dir := t.TempDir()
+	o := fileOptions{mode: defaultFileMode, dirMode: defaultDirMode}
+
+	b, err := newFileBuffer(filepath.Join(dir, "ok.log"), 10, 0, o)
+	assert.NoError(t, err)
+	b.Write([]byte("123"))
+	assert.NoError(t, b.Close())
+	assert.Nil(t, b.w.buf, "buffer should be released after flushing")
+
+	b, err = newFileBuffer(filepath.Join(dir, "fail.log"), 10, 0, o)
+	assert.NoError(t, err)
+	b.Write([]byte("123"))
+	b.f.Close()
+	assert.Error(t, b.Close())
+	assert.Len(t, b.w.buf, 10, "buffer with pending data should not be released")
+}
+
+func BenchmarkFileBufferRotate(b *testing.B) {
+	dir := b.TempDir()
+	o := fileOptions{mode: defaultFileMode, dirMode: defaultDirMode}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fb, err := newFileBuffer(filepath.Join(dir, "test.log"), 64*1024, 0, o)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fb.Write([]byte("data\n"))
+		fb.Close()
+	}
+}
+
+func TestFileBufferFresh(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	o := fileOptions{mode: defaultFileMode, dirMode: defaultDirMode}
+
+	b, err := newFileBuffer(name, 10, 0, o)
+	assert.NoError(t, err)
+	assert.True(t, b.Fresh(), "created file should be fresh")
+	b.Write([]byte("123"))
+	b.Close()
+
+	b, err = newFileBuffer(name, 10, 0, o)
+	assert.NoError(t, err)
+	assert.False(t, b.Fresh(), "appended file should not be fresh")
+	b.Close()
+}
+
+func TestFileBufferFromFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	assert.NoError(t, err)
+
+	b, err := NewFileBufferBorrowing(f, 10, 0)
+	assert.NoError(t, err)
+	b.Write([]byte("123"))
+	assert.NoError(t, b.Close())
+	_, err = f.Write([]byte("456"))
+	assert.NoError(t, err, "borrowed file should be left open")
+
+	b, err = NewFileBufferFromFile(f, 10, 0)
+	assert.NoError(t, err)
+	assert.False(t, b.(*FileBuffer).Fresh(), "written file should not be fresh")
+	b.Write([]byte("789"))
+	assert.NoError(t, b.Close())
+	_, err = f.Write([]byte("0"))
+	assert.Error(t, err, "owned file should be closed")
+
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "123456789", string(content))
+
+	_, err = NewFileBufferFromFile(f, 10, 0)
+	assert.Error(t, err, "closed file should be rejected")
+}
+
+func TestFileBufferSizeName(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	assert.NoError(t, os.WriteFile(name, []byte("old\n"), 0644))
+
+	b, err := NewFileBuffer(name, 10, 0)
+	assert.NoError(t, err)
+
+	var buf Buffer = b
+	assert.Equal(t, int64(4), buf.(Sizer).Size(), "size should start from the existing file")
+	b.Write([]byte("123"))
+	assert.Equal(t, int64(7), buf.(Sizer).Size(), "buffered data should be counted")
+	assert.Equal(t, name, buf.(Named).Name())
+	b.Close()
+	assert.Equal(t, name, buf.(Named).Name(), "name should be kept after close")
+}
+
+func TestFileBufferCloseTwice(t *testing.T) {
+	b, err := newFileBuffer(filepath.Join(t.TempDir(), "test.log"), 10, time.Hour, fileOptions{
+		mode:    defaultFileMode,
+		dirMode: defaultDirMode,
+		sync:    true,
+	})
+	assert.NoError(t, err)
+
+	b.Write([]byte("123"))
+	assert.NoError(t, b.Close())
+	assert.NoError(t, b.Close(), "closing again should not close the file twice")
+	assert.Nil(t, b.f, "file should be released")
+	assert.NoError(t, b.Flush(), "flushing closed buffer should not panic")
+}
@@ -0,0 +1,84 @@
+package rollout
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrFrameTooLarge is returned by FrameReader for records longer than its limit.
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum record size")
+
+// framedBuffer prefixes every write with its length.
+type framedBuffer struct {
+	Buffer
+	frame []byte
+}
+
+// FramedBuffer returns a BufferFunc wrapping buffers of f, prefixing each Write with its length
+// as a uvarint, so every call is a self-delimiting record, as expected for length-delimited
+// protobuf. The prefix and the record are handed to the buffer in one Write, and buffers write
+// each p contiguously, so flushing never splits a record in a way readers can't follow. Use
+// FrameReader to read records back.
+func FramedBuffer(f BufferFunc) BufferFunc {
+	return func(dest string, size int, interval time.Duration) (Buffer, error) {
+		b, err := f(dest, size, interval)
+		if err != nil {
+			return nil, err
+		}
+		return &framedBuffer{Buffer: b}, nil
+	}
+}
+
+// Write writes p as one record. It returns the number of bytes of p written, not counting the
+// length prefix.
+func (b *framedBuffer) Write(p []byte) (int, error) {
+	if need := binary.MaxVarintLen64 + len(p); cap(b.frame) < need {
+		b.frame = make([]byte, 0, need)
+	}
+	frame := binary.AppendUvarint(b.frame[:0], uint64(len(p)))
+	prefix := len(frame)
+	frame = append(frame, p...)
+
+	n, err := b.Buffer.Write(frame)
+	n -= prefix
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+// FrameReader reads records written by FramedBuffer.
+type FrameReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+// NewFrameReader returns a FrameReader reading records from r. Records longer than max bytes fail
+// with ErrFrameTooLarge, a max of 0 means no limit.
+func NewFrameReader(r io.Reader, max int) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r), max: max}
+}
+
+// Next returns the next record. It returns io.EOF when there are no more records, and
+// io.ErrUnexpectedEOF if the last one is truncated.
+func (fr *FrameReader) Next() ([]byte, error) {
+	size, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if fr.max > 0 && size > uint64(fr.max) {
+		return nil, ErrFrameTooLarge
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
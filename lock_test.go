@@ -0,0 +1,29 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package rollout
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileBufferLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.log")
+	o := fileOptions{mode: defaultFileMode, dirMode: defaultDirMode, lock: true}
+
+	b, err := newFileBuffer(name, 10, time.Hour, o)
+	assert.NoError(t, err)
+
+	_, err = newFileBuffer(name, 10, time.Hour, o)
+	assert.True(t, errors.Is(err, ErrLocked), "locked destination should not be opened")
+
+	b.Close()
+	b, err = newFileBuffer(name, 10, time.Hour, o)
+	assert.NoError(t, err, "lock should be released on close")
+	b.Close()
+}
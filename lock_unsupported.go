@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package rollout
+
+import (
+	"os"
+)
+
+// lockFile does nothing on platforms without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,142 @@
+// Package objectstore provides a rollout Buffer shipping destinations to object storage, such as
+// S3. Data is buffered in a temporary file and uploaded when the buffer is closed, which happens
+// when Rollout rotates or closes. The package only depends on the Uploader interface, so the SDK
+// of the storage stays optional. For example, with the AWS SDK:
+//
+//	type s3Uploader struct {
+//		client *manager.Uploader
+//		bucket string
+//	}
+//
+//	func (u s3Uploader) Upload(ctx context.Context, key string, body io.Reader) error {
+//		_, err := u.client.Upload(ctx, &s3.PutObjectInput{Bucket: &u.bucket, Key: &key, Body: body})
+//		return err
+//	}
+//
+//	w := rollout.New(rollout.Options{
+//		Root:       "logs",
+//		BufferFunc: objectstore.NewBufferFunc(s3Uploader{client, "my-bucket"}),
+//	})
+package objectstore
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jerray/rollout"
+)
+
+// Uploader uploads an object to storage.
+type Uploader interface {
+	// Upload stores the content of body as the object key.
+	Upload(ctx context.Context, key string, body io.Reader) error
+}
+
+// Buffer is a thread safe rollout Buffer uploading its content as one object when closed.
+type Buffer struct {
+	uploader Uploader
+	key      string
+
+	mux    sync.Mutex
+	f      *os.File
+	w      *rollout.BufferWriter
+	closed bool
+}
+
+// NewBufferFunc returns a BufferFunc creating Buffer uploading through u. The dest is used as the
+// object key, with slash separators and without leading slash.
+func NewBufferFunc(u Uploader) rollout.BufferFunc {
+	return func(dest string, size int, interval time.Duration) (rollout.Buffer, error) {
+		f, err := os.CreateTemp("", "rollout-*")
+		if err != nil {
+			return nil, err
+		}
+
+		return &Buffer{
+			uploader: u,
+			key:      Key(dest),
+			f:        f,
+			w:        rollout.NewWriterSize(f, size),
+		}, nil
+	}
+}
+
+// Key returns the object key of dest.
+func Key(dest string) string {
+	return strings.TrimLeft(filepath.ToSlash(dest), "/")
+}
+
+// Write writes the contents of p into the buffer.
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return 0, rollout.ErrClosed
+	}
+	return b.w.Write(p)
+}
+
+// Flush writes buffered data to the temporary file. Nothing is uploaded until Close.
+func (b *Buffer) Flush() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	return b.w.Flush()
+}
+
+// UploadError is returned by Close when the content can't be uploaded. The temporary file at Path
+// is kept, holding the content of the object Key, so it can be uploaded again.
+type UploadError struct {
+	Key  string
+	Path string
+	Err  error
+}
+
+func (e *UploadError) Error() string {
+	return "upload " + e.Key + " from " + e.Path + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the upload.
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Close uploads the content and removes the temporary file. If the upload fails, the temporary
+// file is kept and an UploadError is returned.
+func (b *Buffer) Close() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	name := b.f.Name()
+	err := b.upload()
+	b.f.Close()
+	if err != nil {
+		return &UploadError{Key: b.key, Path: name, Err: err}
+	}
+	return os.Remove(name)
+}
+
+// upload flushes the buffer and uploads the temporary file.
+func (b *Buffer) upload() error {
+	if err := b.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return b.uploader.Upload(context.Background(), b.key, b.f)
+}
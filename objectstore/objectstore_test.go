@@ -0,0 +1,80 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jerray/rollout"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryUploader map[string]string
+
+func (u memoryUploader) Upload(ctx context.Context, key string, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	u[key] = string(b)
+	return err
+}
+
+func TestBuffer(t *testing.T) {
+	u := memoryUploader{}
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := rollout.New(rollout.Options{
+		Root:       "/logs",
+		Template:   "test-{{.Time}}.log",
+		BufferFunc: NewBufferFunc(u),
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	r.Write([]byte("day 5\n"))
+	r.Flush()
+	assert.Empty(t, u, "flush should not upload")
+
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+	assert.Equal(t, memoryUploader{"logs/test-2017-11-05.log": "day 5\n"}, u, "rotation should upload the old object")
+
+	r.Close()
+	assert.Equal(t, "day 6\n", u["logs/test-2017-11-06.log"], "close should upload the current object")
+}
+
+func TestBufferRemovesTempFile(t *testing.T) {
+	b, err := NewBufferFunc(memoryUploader{})("test.log", 0, 0)
+	assert.NoError(t, err)
+
+	name := b.(*Buffer).f.Name()
+	assert.NoError(t, b.Close())
+	assert.NoError(t, b.Close(), "closing twice should be a no-op")
+
+	_, err = os.Stat(name)
+	assert.True(t, os.IsNotExist(err), "temporary file should be removed")
+}
+
+type failingUploader struct{}
+
+func (failingUploader) Upload(ctx context.Context, key string, body io.Reader) error {
+	return errors.New("unavailable")
+}
+
+func TestBufferKeepsTempFileOnFailure(t *testing.T) {
+	b, err := NewBufferFunc(failingUploader{})("logs/test.log", 0, 0)
+	assert.NoError(t, err)
+	b.Write([]byte("segment\n"))
+
+	err = b.Close()
+	var uploadErr *UploadError
+	assert.True(t, errors.As(err, &uploadErr), "failed upload should be returned")
+	assert.Equal(t, "logs/test.log", uploadErr.Key)
+	defer os.Remove(uploadErr.Path)
+
+	content, err := os.ReadFile(uploadErr.Path)
+	assert.NoError(t, err, "temporary file should be kept to retry")
+	assert.Equal(t, "segment\n", string(content))
+}
@@ -0,0 +1,125 @@
+package rollout
+
+import (
+	"time"
+)
+
+// maxPrewarmLead is the longest time before a period boundary the next destination is opened.
+const maxPrewarmLead = time.Second
+
+// warmBuffer is a buffer opened ahead of the period at position pos.
+type warmBuffer struct {
+	Buffer
+	pos  int64
+	dest string
+}
+
+// prewarmLead returns how long before a boundary the next destination is opened, a tenth of
+// the Rotation period at most.
+func (r *Rollout) prewarmLead() time.Duration {
+	lead := time.Duration(r.interval) * time.Second / 10
+	if lead > maxPrewarmLead {
+		lead = maxPrewarmLead
+	}
+	return lead
+}
+
+// warmUp opens the destination of the next period in the background when now is close to the
+// boundary. The caller must hold the write lock.
+func (r *Rollout) warmUp(now time.Time, pos int64) {
+	if r.warm != nil || r.warming {
+		return
+	}
+	at := now.Add(r.prewarmLead())
+	next := r.position(at)
+	if next == pos {
+		return
+	}
+
+	dest, err := r.periodDestination(at)
+	if err != nil {
+		return
+	}
+
+	c := BufferConfig{
+		Dest:          dest,
+		Size:          r.bufferSize,
+		MaxBufferSize: r.maxBufferSize,
+		Interval:      r.flushInterval,
+		Mode:          r.fileMode,
+		DirMode:       r.dirMode,
+		Time:          at,
+	}
+	open := r.bufferFunc
+	generation := r.generation
+	r.warming = true
+	r.warmups.Add(1)
+	go func() {
+		defer r.warmups.Done()
+
+		// Errors are left to the boundary Write, which opens the destination itself.
+		buf, err := open(c)
+
+		r.mux.Lock()
+		defer r.unlock()
+		r.warming = false
+		if err != nil {
+			return
+		}
+		if r.generation != generation {
+			// Reconfigured meanwhile, the destination may no longer match the template or Root.
+			r.fail(discardStale(buf, dest))
+			return
+		}
+		if r.closed {
+			buf.Close()
+			return
+		}
+		r.warm = &warmBuffer{Buffer: buf, pos: next, dest: dest}
+	}()
+}
+
+// discardStale closes buf opened ahead for dest, removing its file if nothing was written to it.
+func discardStale(buf Buffer, dest string) error {
+	if fb, ok := buf.(*FileBuffer); ok {
+		if _, err := fb.removeIfEmpty(dest); err != nil {
+			fb.Close()
+			return err
+		}
+	}
+	return buf.Close()
+}
+
+// periodDestination returns the first destination of the period containing t. A new period
+// starts from the first sequence number. The caller must hold the write lock.
+func (r *Rollout) periodDestination(t time.Time) (string, error) {
+	data := r.templateData(t)
+	data["Seq"] = 0
+	return r.render(data)
+}
+
+// takeWarm returns the buffer opened ahead for dest at position pos, or nil if there is none.
+// A buffer opened for another destination of the period, or for a past period, is closed. The
+// caller must hold the write lock.
+func (r *Rollout) takeWarm(dest string, pos int64) Buffer {
+	warm := r.warm
+	if warm == nil || warm.pos > pos {
+		return nil
+	}
+	r.warm = nil
+	if warm.pos != pos || warm.dest != dest {
+		r.fail(warm.Close())
+		return nil
+	}
+	return warm.Buffer
+}
+
+// discardWarm closes the buffer opened ahead, if any. The caller must hold the write lock.
+func (r *Rollout) discardWarm() error {
+	if r.warm == nil {
+		return nil
+	}
+	warm := r.warm
+	r.warm = nil
+	return warm.Close()
+}
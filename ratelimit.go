@@ -0,0 +1,41 @@
+package rollout
+
+import (
+	"time"
+)
+
+// tokenBucket limits the bytes written per second, allowing bursts of one second worth of bytes.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate)}
+}
+
+// take takes n tokens at now. If the bucket doesn't hold enough tokens, nothing is taken and the
+// time to wait for them is returned. A write larger than the burst only waits for a full bucket,
+// and takes it into debt.
+func (b *tokenBucket) take(now time.Time, n int) time.Duration {
+	if !b.last.IsZero() {
+		if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+			b.tokens += elapsed * b.rate
+			if b.tokens > b.rate {
+				b.tokens = b.rate
+			}
+		}
+	}
+	b.last = now
+
+	need := float64(n)
+	if need > b.rate {
+		need = b.rate
+	}
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,422 @@
+package rollout
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinels stand in for the variables that change between destinations when the template
+// is rendered as a pattern. They contain no glob, regexp or path separator characters.
+const (
+	pidSentinel   = "\x00pid\x00"
+	runSentinel   = "\x00run\x00"
+	startSentinel = "\x00start\x00"
+	timeSentinel  = "\x00time\x00"
+	seqSentinel   = "\x00seq\x00"
+	unixSentinel  = "\x00unix\x00"
+	nanoSentinel  = "\x00nano\x00"
+)
+
+var sentinels = regexp.MustCompile("\x00(pid|run|start|time|seq|unix|nano)\x00")
+
+// sentinelExprs are the regexps matching the values of each variable replaced by a sentinel. The
+// time is matched by layoutExpr of the time format instead.
+var sentinelExprs = map[string]string{
+	"pid":   "-?[0-9]+",
+	"run":   ".+",
+	"start": ".+",
+	"seq":   "[0-9]+",
+	"unix":  "-?[0-9]+",
+	"nano":  "-?[0-9]+",
+}
+
+// logFile is an existing destination found in Root. A destination and its compressed copy, both
+// present while compression is in progress, are one logFile.
+type logFile struct {
+	path  string
+	paths []string
+	run   string
+	began string
+	time  string
+	start int64
+	seq   int
+	size  int64
+
+	// at is the time parsed from the name, zero if it has none.
+	at time.Time
+}
+
+// Rotate removes old destinations, keeping at most Keeps of the most recent ones, keeping their
+// total size within MaxTotalBytes, and removing ones whose period ended more than MaxAge ago.
+// Whichever limit is tighter wins. The period of a destination is parsed from its name using
+// TimeFormat. Destinations are found by matching files against the template, including
+// compressed copies and the destinations of earlier runs whatever their Pid, Run or StartTime.
+// They are ordered by the time parsed from their time component, so TimeFormat doesn't need to
+// sort lexically, then by run start time, run and sequence. Files whose time can't be parsed are
+// left alone by all limits. The file currently being written is never removed.
+func (r *Rollout) Rotate() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.rotate()
+}
+
+// SetKeeps changes Keeps of a live Rollout, the next cleanup keeps at most n destinations. Like
+// the option, 0 restores the default of 30, and a negative value keeps all of them.
+func (r *Rollout) SetKeeps(n int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if n == 0 {
+		n = defaultKeeps
+	}
+	r.keeps = n
+}
+
+// SetMaxAge changes MaxAge of a live Rollout, the next cleanup removes destinations older than
+// d. Like the option, 0 disables the limit, and so does a negative value.
+func (r *Rollout) SetMaxAge(d time.Duration) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.maxAge = d
+}
+
+// SetMaxTotalBytes changes MaxTotalBytes of a live Rollout, the next cleanup keeps the total size
+// of destinations within n. Like the option, 0 disables the limit, and so does a negative value.
+func (r *Rollout) SetMaxTotalBytes(n int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.maxTotalBytes = n
+}
+
+// rotate does the work of Rotate. The caller must hold the write lock.
+func (r *Rollout) rotate() error {
+	if r.keeps <= 0 && r.maxTotalBytes <= 0 && r.maxAge <= 0 {
+		return nil
+	}
+
+	files, err := r.destinations()
+	if err != nil {
+		return err
+	}
+
+	var current string
+	if r.buf != nil {
+		current = r.buf.dest
+	}
+
+	remove := make([]bool, len(files))
+	if r.keeps > 0 {
+		for i := 0; i < len(files)-r.keeps; i++ {
+			remove[i] = true
+		}
+	}
+
+	if r.maxAge > 0 {
+		cutoff := r.clock().Add(-r.maxAge)
+		for i, f := range files {
+			// A destination gets older than MaxAge counting from the end of its period.
+			if !f.at.IsZero() && !r.periodEnd(f.at).After(cutoff) {
+				remove[i] = true
+			}
+		}
+	}
+
+	if r.maxTotalBytes > 0 {
+		var total int64
+		for i, f := range files {
+			if !remove[i] {
+				total += f.size
+			}
+		}
+		for i := 0; i < len(files) && total > r.maxTotalBytes; i++ {
+			if !remove[i] && files[i].path != current {
+				remove[i] = true
+				total -= files[i].size
+			}
+		}
+	}
+
+	var errs []error
+	for i, f := range files {
+		if !remove[i] || f.path == current {
+			continue
+		}
+		for _, path := range f.paths {
+			if err := os.Remove(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// destinations lists existing files matching the destination template, from the oldest to the
+// newest. Compressed copies are grouped with their originals, under the original path. Files
+// whose time component doesn't parse with TimeFormat aren't destinations.
+func (r *Rollout) destinations() ([]logFile, error) {
+	loc := r.localTime(r.clock()).Location()
+
+	pattern, matcher, err := r.pattern()
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	layout := filepath.FromSlash(r.fileTimeFormat())
+
+	files := make([]logFile, 0, len(names))
+	index := make(map[string]int, len(names))
+	for _, name := range names {
+		m := matcher.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		var at time.Time
+		if i := matcher.SubexpIndex("time"); i > 0 {
+			// A file only looking like a destination is none of Rotate's business.
+			if at, err = time.ParseInLocation(layout, m[i], loc); err != nil {
+				continue
+			}
+		}
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		path := name
+		if r.compress {
+			path = strings.TrimSuffix(name, r.compressSuffix)
+		}
+		if i, ok := index[path]; ok {
+			files[i].paths = append(files[i].paths, name)
+			files[i].size += info.Size()
+			continue
+		}
+		index[path] = len(files)
+
+		f := logFile{path: path, paths: []string{name}, size: info.Size()}
+		if i := matcher.SubexpIndex("time"); i > 0 {
+			f.time = m[i]
+		}
+		if i := matcher.SubexpIndex("run"); i > 0 {
+			f.run = m[i]
+		}
+		if i := matcher.SubexpIndex("start"); i > 0 {
+			f.began = m[i]
+		}
+		if i := matcher.SubexpIndex("seq"); i > 0 {
+			f.seq, _ = strconv.Atoi(m[i])
+		}
+		if i := matcher.SubexpIndex("unix"); i > 0 {
+			f.start, _ = strconv.ParseInt(m[i], 10, 64)
+			f.at = time.Unix(f.start, 0)
+		} else if i := matcher.SubexpIndex("nano"); i > 0 {
+			nano, _ := strconv.ParseInt(m[i], 10, 64)
+			f.start = nano / int64(time.Second)
+			f.at = time.Unix(f.start, 0)
+		}
+		if f.time != "" {
+			f.at = at
+		}
+		files = append(files, f)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].time != files[j].time {
+			if !files[i].at.Equal(files[j].at) {
+				return files[i].at.Before(files[j].at)
+			}
+			return files[i].time < files[j].time
+		}
+		if files[i].start != files[j].start {
+			return files[i].start < files[j].start
+		}
+		if files[i].began != files[j].began {
+			return files[i].began < files[j].began
+		}
+		if files[i].run != files[j].run {
+			return files[i].run < files[j].run
+		}
+		return files[i].seq < files[j].seq
+	})
+	return files, nil
+}
+
+// pattern renders the template with wildcards in place of the variables changing between
+// destinations. It returns a glob pattern to list candidate files and a regexp whose named
+// groups capture their values.
+func (r *Rollout) pattern() (string, *regexp.Regexp, error) {
+	data := r.templateData(r.clock())
+	data["Pid"] = pidSentinel
+	data["Run"] = runSentinel
+	data["StartTime"] = startSentinel
+	data["Time"] = timeSentinel
+	data["Seq"] = seqSentinel
+	data["Unix"] = unixSentinel
+	data["Nano"] = nanoSentinel
+
+	name, err := r.render(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// A glob wildcard never matches a separator, the time takes one per directory level.
+	sep := string(filepath.Separator)
+	sample := filepath.FromSlash(r.localTime(r.clock()).Format(r.fileTimeFormat()))
+	timeGlob := "*" + strings.Repeat(sep+"*", strings.Count(sample, sep))
+
+	var glob, expr strings.Builder
+	captured := make(map[string]bool)
+	last := 0
+	for _, loc := range sentinels.FindAllStringSubmatchIndex(name, -1) {
+		glob.WriteString(globEscape(name[last:loc[0]]))
+		expr.WriteString(regexp.QuoteMeta(name[last:loc[0]]))
+		last = loc[1]
+
+		group := name[loc[2]:loc[3]]
+		if group == "time" {
+			glob.WriteString(timeGlob)
+		} else {
+			glob.WriteString("*")
+		}
+		groupExpr := sentinelExprs[group]
+		if group == "time" {
+			groupExpr = layoutExpr(filepath.FromSlash(r.fileTimeFormat()))
+		}
+		if captured[group] {
+			expr.WriteString(groupExpr)
+		} else {
+			expr.WriteString("(?P<" + group + ">" + groupExpr + ")")
+			captured[group] = true
+		}
+	}
+	glob.WriteString(globEscape(name[last:]))
+	expr.WriteString(regexp.QuoteMeta(name[last:]))
+
+	if r.compress {
+		// Compressed copies of destinations.
+		glob.WriteString("*")
+		expr.WriteString("(?:" + regexp.QuoteMeta(r.compressSuffix) + ")?")
+	}
+
+	matcher, err := regexp.Compile("^" + expr.String() + "$")
+	if err != nil {
+		return "", nil, err
+	}
+	return glob.String(), matcher, nil
+}
+
+// fileTimeFormat returns the time format as it appears in destination names.
+func (r *Rollout) fileTimeFormat() string {
+	if r.sanitize {
+		return sanitizeFilename(r.timeFormat)
+	}
+	return r.timeFormat
+}
+
+// layoutElems are the elements of time layouts and the regexps matching their values, longest
+// first among those sharing a prefix.
+var layoutElems = []struct {
+	elem string
+	expr string
+}{
+	{"January", "[A-Za-z]+"},
+	{"Jan", "[A-Za-z]{3}"},
+	{"Monday", "[A-Za-z]+"},
+	{"Mon", "[A-Za-z]{3}"},
+	{"MST", "[A-Za-z0-9+-]+"},
+	{"2006", "[0-9]{4}"},
+	{"002", "[0-9]{3}"},
+	{"__2", "[ 0-9]{2}[0-9]"},
+	{"_2", "[ 0-9][0-9]"},
+	{"01", "[0-9]{2}"},
+	{"02", "[0-9]{2}"},
+	{"03", "[0-9]{2}"},
+	{"04", "[0-9]{2}"},
+	{"05", "[0-9]{2}"},
+	{"06", "[0-9]{2}"},
+	{"15", "[0-9]{2}"},
+	{"1", "[0-9]{1,2}"},
+	{"2", "[0-9]{1,2}"},
+	{"3", "[0-9]{1,2}"},
+	{"4", "[0-9]{1,2}"},
+	{"5", "[0-9]{1,2}"},
+	{"PM", "[AP]M"},
+	{"pm", "[ap]m"},
+	{"Z070000", "(?:Z|[+-][0-9]{6})"},
+	{"Z07:00:00", "(?:Z|[+-][0-9]{2}:[0-9]{2}:[0-9]{2})"},
+	{"Z0700", "(?:Z|[+-][0-9]{4})"},
+	{"Z07:00", "(?:Z|[+-][0-9]{2}:[0-9]{2})"},
+	{"Z07", "(?:Z|[+-][0-9]{2})"},
+	{"-070000", "[+-][0-9]{6}"},
+	{"-07:00:00", "[+-][0-9]{2}:[0-9]{2}:[0-9]{2}"},
+	{"-0700", "[+-][0-9]{4}"},
+	{"-07:00", "[+-][0-9]{2}:[0-9]{2}"},
+	{"-07", "[+-][0-9]{2}"},
+}
+
+// layoutExpr returns a regexp matching the times formatted with layout, so only names holding a
+// time in that format are taken for destinations. Characters outside layout elements match
+// literally.
+func layoutExpr(layout string) string {
+	var expr strings.Builder
+	for i := 0; i < len(layout); {
+		if n := fractionLen(layout[i:]); n > 0 {
+			if layout[i+1] == '9' {
+				expr.WriteString("(?:[.,][0-9]+)?")
+			} else {
+				expr.WriteString("[.,][0-9]{" + strconv.Itoa(n-1) + "}")
+			}
+			i += n
+			continue
+		}
+		matched := false
+		for _, e := range layoutElems {
+			if strings.HasPrefix(layout[i:], e.elem) {
+				expr.WriteString(e.expr)
+				i += len(e.elem)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			expr.WriteString(regexp.QuoteMeta(layout[i : i+1]))
+			i++
+		}
+	}
+	return expr.String()
+}
+
+// fractionLen returns the length of the fractional seconds element starting layout, such as
+// ".000" or ",999", or 0 if it doesn't start with one.
+func fractionLen(layout string) int {
+	if len(layout) < 2 || (layout[0] != '.' && layout[0] != ',') || (layout[1] != '0' && layout[1] != '9') {
+		return 0
+	}
+	n := 2
+	for n < len(layout) && layout[n] == layout[1] {
+		n++
+	}
+	if n < len(layout) && layout[n] >= '0' && layout[n] <= '9' {
+		// Like time, digits following make it no fraction.
+		return 0
+	}
+	return n
+}
+
+// globEscape quotes the glob meta characters in s so they match literally.
+func globEscape(s string) string {
+	return strings.NewReplacer("*", "[*]", "?", "[?]", "[", "[[]").Replace(s)
+}
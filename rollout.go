@@ -2,12 +2,18 @@ package rollout
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -16,9 +22,15 @@ import (
 const (
 	defaultBufferSize    = 4096
 	defaultDestTamplate  = "rollout-{{.Time}}.log"
+	defaultSafeTemplate  = "rollout-{{.Time}}-{{.Pid}}.log"
 	defaultTimeFormat    = "2006-01-02"
+	defaultStartFormat   = "20060102T150405"
 	defaultFlushInterval = 10
 	defaultKeeps         = 30
+	defaultFileMode      = 0644
+	defaultDirMode       = 0755
+	defaultWatchInterval = time.Second
+	defaultQueueSize     = 1024
 
 	// RotateSecondly rotate every second
 	RotateSecondly = 1
@@ -39,107 +51,643 @@ const (
 var (
 	defaultClock = time.Now
 
-	host string
-	pid  int
+	hostOnce sync.Once
+	host     string
 
 	ErrClosed = errors.New("write stream closed")
+
+	// ErrSyslogUnsupported is returned by the syslog buffer on platforms without syslog.
+	ErrSyslogUnsupported = errors.New("syslog is not supported on this platform")
+
+	// ErrInvalidDestination is returned when the template renders an empty destination, or one
+	// outside Root.
+	ErrInvalidDestination = errors.New("destination is empty or outside root")
+
+	// ErrRootNotDirectory is returned when Root exists but is not a directory.
+	ErrRootNotDirectory = errors.New("rollout: Root is not a directory")
+
+	// ErrLocked is returned when Lock is set and the destination is locked by another writer.
+	ErrLocked = errors.New("destination is locked by another writer")
 )
 
-func init() {
-	host = getHostname()
-	pid = os.Getpid()
+// hostname returns the name of the host, computed on first use. A random name is used if the
+// host name is unavailable, so the same process always gets the same name.
+func hostname() string {
+	hostOnce.Do(func() {
+		name, err := os.Hostname()
+		if err != nil || name == "" {
+			b := make([]byte, 8)
+			rand.Read(b)
+			name = hex.EncodeToString(b)
+		}
+		host = name
+	})
+	return host
 }
 
-func getHostname() string {
-	var b []byte
-	name, err := os.Hostname()
-	if err == nil {
-		b = []byte(name)
-	} else {
-		b = make([]byte, 1024)
-		rand.Read(b)
-	}
-	h := sha1.New()
-	h.Write(b)
+// hashHostname returns the SHA1 of name in hex.
+func hashHostname(name string) string {
+	h := sha1.Sum([]byte(name))
+	return hex.EncodeToString(h[:])
+}
+
+// TemplateError is returned when the destination template fails to execute, for example when it
+// references an unknown variable.
+type TemplateError struct {
+	Err error
+}
+
+func (e *TemplateError) Error() string {
+	return "rollout: execute template: " + e.Err.Error()
+}
 
-	return hex.EncodeToString(h.Sum(nil))
+// Unwrap returns the underlying template error.
+func (e *TemplateError) Unwrap() error {
+	return e.Err
 }
 
 // Clock function used to get time. Mostly for testing purpose.
 type Clock func() time.Time
 
+// Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker interface {
+	// Chan returns the channel on which the ticks are delivered.
+	Chan() <-chan time.Time
+
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// TickerFunc creates a Ticker ticking every d. Mostly for testing purpose.
+type TickerFunc func(d time.Duration) Ticker
+
+// timeTicker is a Ticker backed by time.Ticker.
+type timeTicker struct {
+	*time.Ticker
+}
+
+func (t timeTicker) Chan() <-chan time.Time {
+	return t.C
+}
+
+func newTimeTicker(d time.Duration) Ticker {
+	return timeTicker{time.NewTicker(d)}
+}
+
 // BufferFunc is function to generate a new Buffer.
 type BufferFunc func(dest string, size int, interval time.Duration) (Buffer, error)
 
+// BufferConfig describes a new Buffer to generate.
+type BufferConfig struct {
+	// Dest is the destination of the buffer.
+	Dest string
+
+	// Size is the buffer size.
+	Size int
+
+	// MaxBufferSize is the size the buffer may grow to, 0 for a fixed size buffer.
+	MaxBufferSize int
+
+	// Interval is the interval of automatic flushing.
+	Interval time.Duration
+
+	// Mode and DirMode are the permissions of new files and directories.
+	Mode    os.FileMode
+	DirMode os.FileMode
+
+	// Time is when the destination is opened.
+	Time time.Time
+
+	// Seq is the sequence number of the destination within its Rotation period.
+	Seq int
+}
+
+// BufferFunc2 is function to generate a new Buffer, like BufferFunc, with the full config of
+// the buffer.
+type BufferFunc2 func(c BufferConfig) (Buffer, error)
+
+// bufferFunc2 adapts f to BufferFunc2.
+func bufferFunc2(f BufferFunc) BufferFunc2 {
+	return func(c BufferConfig) (Buffer, error) {
+		return f(c.Dest, c.Size, c.Interval)
+	}
+}
+
 // Options is data for create Rollout instance.
 type Options struct {
 
-	// Template is a template string for output destination name. Useable variables are `Host`, `Pid` and `Time`.
-	// You can change time format by providing `TimeFormat` option.
+	// Template is a template string for output destination name. Useable variables are `Host`, `Pid`, `Run`,
+	// `StartTime`, `Shard`, `Time`, `Seq`, `Unix` and `Nano`. You can change time format by providing
+	// `TimeFormat` option. `Seq` is a counter starting from zero in each Rotation period, it increments every
+	// time a new destination is created within the period, for example when `MaxSize` is reached. `Unix` and `Nano` are the start of the Rotation period
+	// in seconds and nanoseconds since the epoch. Unlike `Time`, they never collide between periods whatever
+	// the time format is.
 	// In the situation of multiple processes, it is highly recommended to add `{{.Pid}}` in the template to avoid
 	// writing conflicts. If you run multiple processes in docker in the same machine, and they all write to the
-	// same directory in the host, add `{{.Host}}` in the template.
+	// same directory in the host, add `{{.Host}}` in the template. `Run` is stable for the lifetime of the
+	// Rollout and differs between runs, add it to keep each run in its own file even within one period.
+	// `StartTime` is when New was called, formatted with `StartTimeFormat`, which tells runs apart
+	// better than `Pid` since PIDs get reused. Default is "rollout-{{.Time}}.log", see SafeDefault.
 	Template string
 
+	// SafeDefault makes the default Template "rollout-{{.Time}}-{{.Pid}}.log", so processes sharing
+	// a directory never interleave writes in one file. It is off to keep destinations of existing
+	// deployments, new ones should turn it on.
+	SafeDefault bool
+
+	// Fields are custom template variables, such as a tenant or an environment. They are available
+	// both as `{{.Fields.tenant}}` and top-level `{{.tenant}}`. Built-in variables take precedence
+	// over fields with the same name, which NewWithError rejects.
+	Fields map[string]interface{}
+
+	// Pid is the value of `{{.Pid}}`. Default is the process ID. Setting it makes destinations
+	// deterministic in tests, or lets one process act as several writers.
+	Pid int
+
+	// Shards is the number of Rollouts created by NewSharded, each writing destinations of its own
+	// told apart by `{{.Shard}}`. It is ignored by New, whose `{{.Shard}}` is always 0.
+	Shards int
+
+	// Run is the value of `{{.Run}}`. Default is the time New is called, in nanoseconds since the
+	// epoch in base 36, so later runs get greater tokens.
+	Run string
+
+	// Host is the value of `{{.Host}}`. Default is the host name given by the OS.
+	Host string
+
+	// HashHost makes `{{.Host}}` the SHA1 of Host in hex, as older versions did, keeping
+	// destination names of existing deployments.
+	HashHost bool
+
 	// TimeFormat is format string for `Template`'s Time field value. Default is "2016-01-02".
+	// It may contain slashes, for example "2006/01/02", to put destinations in a hierarchy of date
+	// directories, which are created as needed. Slashes in the template and the time are converted
+	// to the separator of the OS, so the same format works on Windows.
 	TimeFormat string
 
+	// StartTimeFormat is format string for `Template`'s StartTime field value. Default is
+	// "20060102T150405".
+	StartTimeFormat string
+
+	// SanitizeFilename replaces the characters not allowed in Windows file names in the rendered
+	// template, so a time format such as "15:04:05" works on every OS. A colon is replaced with
+	// "-", and each of `<>"|?*` with "_". Root is left untouched.
+	SanitizeFilename bool
+
 	// Root is prefix of output destination name. In the built-in file buffer, it is treated as file directory.
 	Root string
 
 	// Rotation is the frequency how often write to a new destination. Default is RotateDaily.
 	Rotation int
 
-	// Keeps is how many destination copies will be retained. Default is 30.
+	// MaxSize is the maximum size in bytes of a destination. A write that would grow the current
+	// destination beyond MaxSize rotates to a new one, even within the same Rotation period. Add
+	// `{{.Seq}}` in the template to tell such destinations apart. Default is 0, no size limit.
+	MaxSize int64
+
+	// Keeps is how many destination copies will be retained. Older copies are removed after each
+	// rotation when the built-in file buffer is used. Default is 30, a negative value keeps all.
 	Keeps int
 
+	// MaxTotalBytes is the maximum total size in bytes of retained destinations, compressed copies
+	// included. The oldest destinations are removed after each rotation until the total fits, along
+	// with Keeps. Default is 0, no limit.
+	MaxTotalBytes int64
+
+	// MaxAge is how long destinations are retained once their period ended, based on the time in
+	// their names. Older ones are removed after each rotation, along with Keeps. Default is 0, no
+	// limit.
+	MaxAge time.Duration
+
 	// BufferSize is the size of underlying buffer. Default is 4096.
 	BufferSize int
 
+	// MaxBufferSize lets the buffer of the built-in file buffer grow up to this size for writes
+	// larger than the space left, instead of writing them directly to the file. It saves syscalls
+	// for occasional medium-large writes, writes beyond it are still written directly. Default is
+	// 0, a fixed size buffer.
+	MaxBufferSize int
+
 	// Flush is the interval for buffer automaticly flushing. Default is 10.
 	Flush int
 
+	// FlushJitter delays the first interval flush of each built-in file buffer by a random
+	// duration up to it, spreading the flushes of processes started together, for example by a
+	// deploy, instead of all hitting the disk on the same boundary. It doesn't apply to
+	// SharedFlush. Default is 0, no delay.
+	FlushJitter time.Duration
+
+	// Header is written to every new destination before any data, for example a byte order mark
+	// or column names. It counts toward MaxSize, and is written again to each destination rotated
+	// in. A destination which isn't empty when opened, such as one appended to after a restart
+	// within the same period, gets no header. Custom buffers may tell that with a `Fresh() bool`
+	// method, like FileBuffer, otherwise they always get the header.
+	Header []byte
+
+	// HeaderFunc returns the header of the destination dest, opened at t. It takes precedence over
+	// Header.
+	HeaderFunc func(dest string, t time.Time) []byte
+
+	// Footer is written to every destination when it is closed, on rotation, Reopen or Close. It
+	// completes formats needing a closing sequence, such as a JSON array. A process restarted
+	// within the period appends after the footer of the previous run, add `{{.Run}}` to the
+	// template to give each run its own destination when that breaks the format.
+	Footer []byte
+
+	// FooterFunc returns the footer of the destination dest, closed at t. It takes precedence over
+	// Footer.
+	FooterFunc func(dest string, t time.Time) []byte
+
+	// Unbuffered makes every Write flush the buffer, so data reaches the destination immediately,
+	// for example to follow it with tail -f. Interval flushing of the built-in file buffer and
+	// AutoFlush are disabled, while BufferFunc and BufferFunc2 are still given the Flush interval.
+	// BufferSize still sizes the buffer holding a single write, larger writes go to the
+	// destination directly.
+	Unbuffered bool
+
+	// HighWaterMark is the number of buffered bytes above which OnHighWaterMark is called after a
+	// write, to throttle upstream. Default is 0, disabled.
+	HighWaterMark int
+
+	// OnRotate is called with the path of every destination opened, the first one included, and
+	// the time it is opened at, for example to chmod the file or register it with a watcher. It is
+	// called outside the write lock but synchronously, so blocking in it stalls the Write which
+	// opened the destination, offload heavy work to another goroutine.
+	OnRotate func(newPath string, t time.Time)
+
+	// OnHighWaterMark is called with the number of buffered bytes when it exceeds HighWaterMark.
+	// Like OnError, it is never called while holding the write lock.
+	OnHighWaterMark func(buffered int)
+
+	// FlushOnIdle makes Rollout call Flush once no write happened for this duration, so the last
+	// lines of a burst reach the destination soon after it ends, instead of waiting for the next
+	// interval flush. Flush errors go to OnError. Default is 0, disabled.
+	FlushOnIdle time.Duration
+
+	// AutoFlush makes Rollout call Flush every Flush seconds, so custom buffers without interval
+	// flushing of their own don't hold data until rotation or Close. Flush errors go to OnError.
+	AutoFlush bool
+
+	// MaxBytesPerSecond limits the rate of writes, allowing bursts of one second worth of bytes.
+	// Writes exceeding it are dropped and counted in Stats.Dropped, they are reported written so
+	// callers carry on. Default is 0, no limit.
+	MaxBytesPerSecond int64
+
+	// RateLimitBlock makes writes exceeding MaxBytesPerSecond wait instead of being dropped. Waiting
+	// holds the write lock, so it slows down all writers, and it relies on Clock to advance.
+	RateLimitBlock bool
+
 	// BufferFunc is a function generating new buffer. Default value is the built-in NewFileBuffer.
 	BufferFunc BufferFunc
 
+	// BufferFunc2 is a function generating new buffer from its full config. It takes precedence
+	// over BufferFunc.
+	BufferFunc2 BufferFunc2
+
 	// Clock is function to get current time.
 	Clock Clock
+
+	// Ticker creates the ticker driving interval flushing of the built-in file buffer. Together with
+	// Clock it makes time fully controllable in tests. Default uses time.NewTicker.
+	Ticker TickerFunc
+
+	// Location is the time zone of `Time` in the template, and the zone daily or longer periods are
+	// aligned to its midnight. The zone offset is looked up for each time, so periods follow
+	// daylight saving time changes. Default is the location of times returned by Clock.
+	Location *time.Location
+
+	// CloseGrace is how long Close waits after closing the channel returned by Closing before it
+	// marks the Rollout closed, so producers watching it can hand over their final writes. The wait
+	// is bounded by the context of CloseContext. Default is 0, no wait.
+	CloseGrace time.Duration
+
+	// WriteTimeout bounds how long Write waits for the buffer, protecting callers from custom
+	// buffers blocked on slow writers, such as a network. A write not completed in time fails with
+	// ErrWriteTimeout, but stays in flight and may still land in the destination later, so retrying
+	// it may duplicate data. Until it completes, other writes, rotations and Close wait for it, and
+	// fail with ErrWriteTimeout too if it takes another WriteTimeout. Flush, Sync and Tail wait for
+	// it the same way, and Buffered and Available report 0 meanwhile, so the buffer is never called
+	// concurrently. Default is 0, no timeout.
+	WriteTimeout time.Duration
+
+	// UTC aligns daily or longer periods to midnight UTC and formats `Time` in UTC, whatever the
+	// time zone of the machine, for consistent files across regions. It takes precedence over
+	// Location.
+	UTC bool
+
+	// Async makes Write queue data and return immediately, leaving the actual writing and rotation
+	// to a background goroutine. Close writes all queued data before closing. Queued data is lost if
+	// the process exits without calling Close. Callbacks such as OnError and OnRotate due to queued
+	// writes run, in order, on another goroutine than the one writing, so they may write to the
+	// Rollout themselves.
+	Async bool
+
+	// QueueSize is how many writes can be queued in async mode before Write blocks. Default is 1024.
+	QueueSize int
+
+	// EnsureNewline appends a newline to every write not ending with one, so each write is a line
+	// of its own, as expected by newline-delimited formats like JSON lines.
+	EnsureNewline bool
+
+	// Transform is applied to every write before it is buffered, for example to redact sensitive
+	// data, and before EnsureNewline. It must not modify p, but return a new slice, a nil or empty
+	// one drops the write. Write still reports the length of p as written. Transform runs under
+	// the write lock, in the writing goroutine of async mode, so it should be fast.
+	Transform func(p []byte) []byte
+
+	// OnError is called with errors happening in background, which can't be returned to the caller,
+	// such as failures of the built-in file buffer's interval flushing, or of closing, compressing and
+	// removing destinations when rotating. Errors closing a destination rotated out are
+	// *os.PathError with Op "close" and its path, writes go on to the new one. It is never called
+	// while holding the write lock, so it is safe to log from it. The same errors are sent to the
+	// Errors channel.
+	OnError func(error)
+
+	// FileMode is the permission bits of destinations created by the built-in file buffer. Default is 0644.
+	FileMode os.FileMode
+
+	// DirMode is the permission bits of directories created by the built-in file buffer. Missing
+	// directories of a destination, including ones from the template, are created on open. Default is 0755.
+	DirMode os.FileMode
+
+	// Sync makes the built-in file buffer sync the file to disk after every flush, including interval
+	// flushing. It makes data durable on crash, at the expense of write performance.
+	Sync bool
+
+	// SyncOnRotate makes the built-in file buffer sync the file to disk only when it is closed, on
+	// rotation or Close. It is a cheaper alternative to Sync.
+	SyncOnRotate bool
+
+	// WatchDeletion makes Write check, at most once a second, whether the current destination is
+	// still in place. If it was deleted or replaced by another file, for example by an operator or
+	// a tool unable to signal the process, a new file is opened at the same path. It only applies
+	// to the built-in file buffer, and complements Reopen.
+	WatchDeletion bool
+
+	// SharedFlush makes the built-in file buffers of all Rollouts with SharedFlush flush from one
+	// goroutine and ticker per Flush interval, instead of one of each per buffer. It coalesces
+	// flushes of processes running many Rollouts. Ticker doesn't apply to shared flushing.
+	SharedFlush bool
+
+	// RemoveEmpty removes destinations of the built-in file buffer left empty when they are rotated
+	// out or closed, for example by RotateNow or Reopen without writes, so jobs which often log
+	// nothing don't litter Root. A destination written to by another process is kept.
+	RemoveEmpty bool
+
+	// ManualRotate keeps writing to the current destination when the Rotation period changes. The
+	// change is reported once per period on RotationEvents, with Pending set, and the rotation
+	// happens when RotateNow is called. MaxSize rotations wait for it as well. It decouples
+	// rotation scheduling from its execution.
+	ManualRotate bool
+
+	// Prewarm opens the destination of the next period in the background shortly before the
+	// boundary, a second or a tenth of the Rotation period at most, so the Write crossing it
+	// swaps to an open buffer instead of creating the file. Opening ahead is triggered by writes
+	// near the boundary. Closing right before a boundary may leave an empty next destination.
+	Prewarm bool
+
+	// Lock makes the built-in file buffer take an exclusive advisory lock (flock) on destinations
+	// it opens. Opening a destination already locked, likely by another process using the same
+	// template, fails with ErrLocked instead of interleaving writes. It has no effect on platforms
+	// without flock.
+	Lock bool
+
+	// Symlink is the path of a symbolic link pointing at the current destination. It is updated after
+	// each rotation when the built-in file buffer is used. A relative path is treated as relative to Root.
+	Symlink string
+
+	// Compress enables compression of destinations after they are rotated out, and of the last
+	// one on Close, with gzip unless Compressor is set. Compressed copies are named with
+	// CompressSuffix and the originals are removed. A destination reopened after its compression,
+	// by a restart within the same period, is appended to the existing copy as another member. It
+	// only applies to the built-in file buffer.
+	Compress bool
+
+	// CompressLevel is the gzip compression level. Default is gzip.DefaultCompression. It is
+	// ignored with a custom Compressor.
+	CompressLevel int
+
+	// CompressSuffix is appended to the name of compressed copies. Default is ".gz".
+	CompressSuffix string
+
+	// Compressor returns a writer compressing data to dst, for example a zstd encoder, keeping
+	// this package free of dependencies. Set CompressSuffix along with it. The format should allow
+	// concatenated streams, since a restarted period is appended to its existing copy. Default is
+	// gzip at CompressLevel.
+	Compressor func(dst io.Writer) (io.WriteCloser, error)
+
+	// RenameFunc returns the new path of a destination after it is rotated out and closed, such as
+	// a path in an archive directory. Missing directories are created. The file is renamed before
+	// compression. Returning the original path or an empty string leaves it in place. It only applies
+	// to the built-in file buffer, and is called in background, except for the last destination on
+	// Close. Renamed files are no longer destinations, so Keeps, MaxAge and MaxTotalBytes don't count
+	// or remove them unless the new path still matches Template under Root.
+	RenameFunc func(original string) string
+
+	// PostRotate is called in background with the final path of each destination rotated out,
+	// after it is renamed and compressed, for example to upload it. It is called for the last
+	// destination on Close as well, and Close waits for pending calls. Errors go to OnError.
+	PostRotate func(oldPath string) error
 }
 
 // Rollout is an io.WriteCloser. It is used for writing logs to rolling files.
 // Output Buffer is an interface, so you can define your own Buffer and BufferFunc
 // to use another underlying writer other than built-in file buffer.
 type Rollout struct {
-	bufferSize    int
-	bufferFunc    BufferFunc
-	clock         Clock
-	flushInterval time.Duration
-	interval      int
-	root          string
-	template      *template.Template
-	timeFormat    string
-	keeps         int
-	zoneOffset    int
+	bufferSize     int
+	maxBufferSize  int
+	bufferFunc     BufferFunc2
+	clock          Clock
+	ticker         TickerFunc
+	flushInterval  time.Duration
+	unbuffered     bool
+	highWaterMark  int
+	onHighWater    func(int)
+	onRotate       func(string, time.Time)
+	opened         []RotationEvent
+	limiter        *tokenBucket
+	rateLimitBlock bool
+	interval       int
+	root           string
+	template       *template.Template
+	timeFormat     string
+	host           string
+	pid            int
+	run            string
+	shard          int
+	startTime      string
+	fields         map[string]interface{}
+	sanitize       bool
+	keeps          int
+	location       *time.Location
+	fileBuffer     bool
+	maxSize        int64
+	maxTotalBytes  int64
+	maxAge         time.Duration
+	symlink        string
+	seq            int
+	compress       bool
+	compressor     func(io.Writer) (io.WriteCloser, error)
+	compressSuffix string
+	renameFunc     func(string) string
+	postRotate     func(string) error
+	onError        func(error)
+	fileMode       os.FileMode
+	dirMode        os.FileMode
+	ensureNewline  bool
+	transform      func(p []byte) []byte
+	sync           bool
+	syncOnRotate   bool
+	lock           bool
+	watchDeletion  bool
+	watched        time.Time
+	prewarm        bool
+	manualRotate   bool
+	removeEmpty    bool
+	duePos         int64
+	writeTimeout   time.Duration
+	closeGrace     time.Duration
+	flushOnIdle    time.Duration
+	sharedFlush    bool
+	flushJitter    time.Duration
+	headerBytes    []byte
+	headerFunc     func(dest string, t time.Time) []byte
+	footerBytes    []byte
+	footerFunc     func(dest string, t time.Time) []byte
 
 	mux    sync.RWMutex
 	buf    *rolloutBuffer
 	closed bool
+	errs   []error
+	queue  *asyncQueue
+	events chan RotationEvent
+
+	// highWater is the buffered size to pass to OnHighWaterMark on unlock.
+	highWater int
+
+	// errCh receives reported errors for Errors.
+	errCh chan error
+
+	// closing is closed once when Close begins.
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	// inflight is closed when a write which timed out completes.
+	inflight chan struct{}
+
+	// warm is the buffer of the next period opened ahead by Prewarm, warming is set while it is
+	// being opened, and warmups tracks the goroutines opening it. generation counts Reconfigure
+	// calls, so a buffer opened ahead for the previous destination is discarded.
+	warm       *warmBuffer
+	warming    bool
+	warmups    sync.WaitGroup
+	generation uint64
+
+	// idleTimer flushes once writes stop for FlushOnIdle.
+	idleTimer *time.Timer
+
+	// flushDone stops AutoFlush when closed, flushing tracks its goroutine.
+	flushDone chan struct{}
+	flushing  sync.WaitGroup
+
+	// finalizing tracks background finalization of rotated out destinations.
+	finalizing sync.WaitGroup
+
+	counters counters
 }
 
-// New creates Rollout instance.
+// New creates Rollout instance. An invalid template is replaced by the default template, use
+// NewWithError to catch such mistakes.
 func New(options Options) *Rollout {
-	if options.Rotation <= 0 {
-		options.Rotation = RotateDaily
+	tpl, err := parseTemplate(options.Template, options.SafeDefault)
+	if err != nil {
+		tpl, _ = parseTemplate("", options.SafeDefault)
+	}
+	return newRollout(options, tpl)
+}
+
+// NewWithError creates Rollout instance like New, but returns an error if options are invalid.
+// The template must parse and execute, and negative numeric settings are rejected. Zero values
+// still take the defaults.
+func NewWithError(options Options) (*Rollout, error) {
+	switch {
+	case options.Rotation < 0:
+		return nil, fmt.Errorf("rollout: invalid Rotation %d", options.Rotation)
+	case options.BufferSize < 0:
+		return nil, fmt.Errorf("rollout: invalid BufferSize %d", options.BufferSize)
+	case options.MaxBufferSize < 0:
+		return nil, fmt.Errorf("rollout: invalid MaxBufferSize %d", options.MaxBufferSize)
+	case options.Flush < 0:
+		return nil, fmt.Errorf("rollout: invalid Flush %d", options.Flush)
+	case options.QueueSize < 0:
+		return nil, fmt.Errorf("rollout: invalid QueueSize %d", options.QueueSize)
+	case options.MaxBytesPerSecond < 0:
+		return nil, fmt.Errorf("rollout: invalid MaxBytesPerSecond %d", options.MaxBytesPerSecond)
+	case options.MaxSize < 0:
+		return nil, fmt.Errorf("rollout: invalid MaxSize %d", options.MaxSize)
+	case options.MaxTotalBytes < 0:
+		return nil, fmt.Errorf("rollout: invalid MaxTotalBytes %d", options.MaxTotalBytes)
+	case options.MaxAge < 0:
+		return nil, fmt.Errorf("rollout: invalid MaxAge %s", options.MaxAge)
+	case options.CloseGrace < 0:
+		return nil, fmt.Errorf("rollout: invalid CloseGrace %s", options.CloseGrace)
+	case options.WriteTimeout < 0:
+		return nil, fmt.Errorf("rollout: invalid WriteTimeout %s", options.WriteTimeout)
+	case options.FlushJitter < 0:
+		return nil, fmt.Errorf("rollout: invalid FlushJitter %s", options.FlushJitter)
+	case options.FlushOnIdle < 0:
+		return nil, fmt.Errorf("rollout: invalid FlushOnIdle %s", options.FlushOnIdle)
+	case options.CompressLevel < gzip.HuffmanOnly || options.CompressLevel > gzip.BestCompression:
+		return nil, fmt.Errorf("rollout: invalid CompressLevel %d", options.CompressLevel)
+	}
+
+	for _, name := range reservedFields {
+		if _, ok := options.Fields[name]; ok {
+			return nil, fmt.Errorf("rollout: field %s is reserved", name)
+		}
 	}
 
-	if options.Template == "" {
-		options.Template = defaultDestTamplate
+	tpl, err := parseTemplate(options.Template, options.SafeDefault)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRollout(options, tpl)
+	if err := r.checkRoot(); err != nil {
+		return nil, err
+	}
+	if _, err := r.destination(r.clock()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseTemplate parses the destination template. An empty text gives the default template, the
+// one with Pid if safe is set.
+func parseTemplate(text string, safe bool) (*template.Template, error) {
+	switch {
+	case text != "":
+	case safe:
+		text = defaultSafeTemplate
+	default:
+		text = defaultDestTamplate
+	}
+	return template.New("package.rollout.filename").Option("missingkey=error").Parse(text)
+}
+
+func newRollout(options Options, tpl *template.Template) *Rollout {
+	if options.Rotation <= 0 {
+		options.Rotation = RotateDaily
 	}
 
 	if options.TimeFormat == "" {
 		options.TimeFormat = defaultTimeFormat
 	}
 
+	if options.StartTimeFormat == "" {
+		options.StartTimeFormat = defaultStartFormat
+	}
+
 	if options.BufferSize <= 0 {
 		options.BufferSize = defaultBufferSize
 	}
@@ -147,126 +695,1192 @@ func New(options Options) *Rollout {
 	if options.Flush <= 0 {
 		options.Flush = defaultFlushInterval
 	}
+	if options.UTC {
+		options.Location = time.UTC
+	}
 
 	if options.Clock == nil {
 		options.Clock = defaultClock
 	}
 
-	if options.BufferFunc == nil {
-		options.BufferFunc = NewFileBuffer
+	if options.Pid == 0 {
+		options.Pid = os.Getpid()
+	}
+	if options.Run == "" {
+		options.Run = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if options.Host == "" {
+		options.Host = hostname()
+	}
+	if options.HashHost {
+		options.Host = hashHostname(options.Host)
 	}
 
-	tpl := template.New("package.rollout.filename")
-	tpl, err := tpl.Parse(options.Template)
-	if err != nil {
-		tpl, _ = tpl.Parse(defaultDestTamplate)
+	if options.Ticker == nil {
+		options.Ticker = newTimeTicker
+	}
+
+	if options.CompressLevel == 0 {
+		options.CompressLevel = gzip.DefaultCompression
+	}
+	if options.Compressor == nil {
+		options.Compressor = gzipCompressor(options.CompressLevel)
+	}
+
+	if options.CompressSuffix == "" {
+		options.CompressSuffix = defaultCompressSuffix
+	}
+
+	if options.FileMode == 0 {
+		options.FileMode = defaultFileMode
+	}
+
+	if options.DirMode == 0 {
+		options.DirMode = defaultDirMode
+	}
+
+	if options.Keeps == 0 {
+		options.Keeps = defaultKeeps
 	}
 
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+
+	fileBuffer := options.BufferFunc == nil && options.BufferFunc2 == nil
+
 	r := Rollout{
-		interval:      options.Rotation,
-		root:          options.Root,
-		template:      tpl,
-		timeFormat:    options.TimeFormat,
-		bufferSize:    options.BufferSize,
-		bufferFunc:    options.BufferFunc,
-		flushInterval: time.Duration(options.Flush) * time.Second,
-		clock:         options.Clock,
-		keeps:         options.Keeps,
+		interval:       options.Rotation,
+		root:           options.Root,
+		template:       tpl,
+		timeFormat:     options.TimeFormat,
+		host:           options.Host,
+		pid:            options.Pid,
+		run:            options.Run,
+		fields:         options.Fields,
+		sanitize:       options.SanitizeFilename,
+		bufferSize:     options.BufferSize,
+		maxBufferSize:  options.MaxBufferSize,
+		bufferFunc:     options.BufferFunc2,
+		flushInterval:  time.Duration(options.Flush) * time.Second,
+		unbuffered:     options.Unbuffered,
+		highWaterMark:  options.HighWaterMark,
+		onHighWater:    options.OnHighWaterMark,
+		onRotate:       options.OnRotate,
+		rateLimitBlock: options.RateLimitBlock,
+		clock:          options.Clock,
+		ticker:         options.Ticker,
+		location:       options.Location,
+		keeps:          options.Keeps,
+		maxSize:        options.MaxSize,
+		maxTotalBytes:  options.MaxTotalBytes,
+		maxAge:         options.MaxAge,
+		symlink:        options.Symlink,
+		fileBuffer:     fileBuffer,
+		compress:       options.Compress,
+		compressor:     options.Compressor,
+		compressSuffix: options.CompressSuffix,
+		onError:        options.OnError,
+		ensureNewline:  options.EnsureNewline,
+		transform:      options.Transform,
+		sync:           options.Sync,
+		syncOnRotate:   options.SyncOnRotate,
+		lock:           options.Lock,
+		watchDeletion:  options.WatchDeletion,
+		prewarm:        options.Prewarm,
+		manualRotate:   options.ManualRotate,
+		removeEmpty:    options.RemoveEmpty,
+		writeTimeout:   options.WriteTimeout,
+		closeGrace:     options.CloseGrace,
+		flushOnIdle:    options.FlushOnIdle,
+		sharedFlush:    options.SharedFlush,
+		flushJitter:    options.FlushJitter,
+		headerBytes:    options.Header,
+		headerFunc:     options.HeaderFunc,
+		footerBytes:    options.Footer,
+		footerFunc:     options.FooterFunc,
+		postRotate:     options.PostRotate,
+		fileMode:       options.FileMode,
+		dirMode:        options.DirMode,
+	}
+
+	r.errCh = make(chan error, errorsSize)
+	r.closing = make(chan struct{})
+	r.startTime = r.localTime(options.Clock()).Format(options.StartTimeFormat)
+
+	if options.MaxBytesPerSecond > 0 {
+		r.limiter = newTokenBucket(options.MaxBytesPerSecond)
+	}
+
+	// Compress, RenameFunc and WatchDeletion only apply to destinations of the file buffer, but are
+	// kept for Reconfigure switching back to it.
+	r.renameFunc = options.RenameFunc
+	if fileBuffer {
+		r.bufferFunc = r.newFileBuffer
+	} else if r.bufferFunc == nil {
+		r.bufferFunc = bufferFunc2(options.BufferFunc)
 	}
 
-	_, r.zoneOffset = options.Clock().Zone()
+	if r.symlink != "" && !filepath.IsAbs(r.symlink) {
+		r.symlink = filepath.Join(r.root, r.symlink)
+	}
+
+	if options.Async {
+		r.queue = newAsyncQueue(options.QueueSize)
+		go r.consume()
+		go r.notify()
+	}
+
+	if options.AutoFlush && !r.unbuffered {
+		r.flushDone = make(chan struct{})
+		r.flushing.Add(1)
+		go r.flushAtInterval()
+	}
 
 	return &r
 }
 
 type rolloutBuffer struct {
 	Buffer
-	pos int
+	pos  int64
+	dest string
+	size int64
+
+	// finished is set once the footer is written and the buffer closed.
+	finished bool
+
+	// removed is set when the destination was removed for being empty.
+	removed bool
+
+	// file is set for destinations of the built-in file buffer, only those are renamed,
+	// compressed and watched for deletion.
+	file bool
 }
 
 // Write writes the contents of p into the buffer. It returns an error if its status
-// is closed or it fails to create the logging file.
+// is closed or it fails to create the logging file. As required by io.Writer, n is the
+// number of bytes consumed from p, and a non-nil error is returned whenever n < len(p).
+//
+// In async mode, p is queued and Write returns immediately. Errors of the actual write are passed
+// to OnError instead.
 func (r *Rollout) Write(p []byte) (n int, err error) {
-	r.mux.RLock()
+	if r.queue != nil {
+		return r.queue.push(p)
+	}
+
+	r.mux.Lock()
+	defer r.unlock()
+
 	if r.closed {
-		r.mux.RUnlock()
 		return 0, ErrClosed
 	}
-	r.mux.RUnlock()
+	return r.write(p)
+}
+
+// WriteR writes p like Write, and reports whether the write opened a new destination, for example
+// to log a marker on rotation. In async mode, p is queued and rotated is always false.
+func (r *Rollout) WriteR(p []byte) (n int, rotated bool, err error) {
+	if r.queue != nil {
+		n, err = r.queue.push(p)
+		return n, false, err
+	}
 
 	r.mux.Lock()
-	defer r.mux.Unlock()
+	defer r.unlock()
+
+	if r.closed {
+		return 0, false, ErrClosed
+	}
+	return r.writeR(p)
+}
+
+// readFromSize is the size of chunks ReadFrom reads.
+const readFromSize = 32 * 1024
+
+// ReadFrom writes data read from src until EOF, implementing io.ReaderFrom so io.Copy uses it. It
+// hands data over in chunks ending at line boundaries whenever possible, so rotation never splits
+// a line shorter than a chunk, and a source returning small reads is written once per chunk instead
+// of once per read. It returns the number of bytes written.
+func (r *Rollout) ReadFrom(src io.Reader) (int64, error) {
+	buf := getBuffer(readFromSize)
+	defer putBuffer(buf)
+
+	var written int64
+	var pending int
+	for {
+		n, err := src.Read(buf[pending:])
+		pending += n
+
+		// Hold the tail of a partial line back for the next read, or until EOF.
+		chunk := pending
+		if err == nil {
+			if i := bytes.LastIndexByte(buf[:pending], '\n'); i >= 0 {
+				chunk = i + 1
+			} else if pending < len(buf) {
+				chunk = 0
+			}
+		}
+		if chunk > 0 {
+			m, werr := r.Write(buf[:chunk])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			pending = copy(buf, buf[chunk:pending])
+		}
+
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// SafeWriter returns an io.Writer which never fails. Data is written to Rollout, and discarded if
+// the write fails, for example when it is closed or the buffer can't be created. It is meant for
+// libraries which can't handle write errors. Discarded writes are counted in Stats.Dropped.
+func (r *Rollout) SafeWriter() io.Writer {
+	return safeWriter{r}
+}
+
+type safeWriter struct {
+	r *Rollout
+}
+
+func (w safeWriter) Write(p []byte) (int, error) {
+	if _, err := w.r.Write(p); err != nil {
+		w.r.counters.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// write does the work of Write. The caller must hold the write lock.
+func (r *Rollout) write(p []byte) (int, error) {
+	n, _, err := r.writeR(p)
+	return n, err
+}
+
+// writeR does the work of WriteR. The caller must hold the write lock.
+func (r *Rollout) writeR(p []byte) (n int, rotated bool, err error) {
+	defer func() {
+		if err != nil {
+			r.counters.writeErrors.Add(1)
+		}
+	}()
+
+	data := p
+	if r.transform != nil {
+		data = r.transform(p)
+		if len(data) == 0 && len(p) > 0 {
+			return len(p), false, nil
+		}
+	}
+	if r.ensureNewline && len(data) > 0 && data[len(data)-1] != '\n' {
+		// Append in a copy, one Write call keeps the line in one piece.
+		line := make([]byte, len(data)+1)
+		copy(line, data)
+		line[len(data)] = '\n'
+		data = line
+	}
+
+	if r.limiter != nil {
+		for {
+			wait := r.limiter.take(r.clock(), len(data))
+			if wait == 0 {
+				break
+			}
+			if !r.rateLimitBlock {
+				r.counters.dropped.Add(1)
+				return len(p), false, nil
+			}
+			time.Sleep(wait)
+		}
+	}
+
+	if err := r.awaitInflight(); err != nil {
+		return 0, false, err
+	}
 
 	now := r.clock()
 	pos := r.position(now)
 
-	if r.buf == nil || r.buf.pos != pos {
-		buf, err := r.bufferFunc(r.destination(now), r.bufferSize, r.flushInterval)
+	rollover := r.buf == nil || r.buf.pos != pos
+	if rollover && r.buf != nil && r.manualRotate {
+		// Report the rotation due, RotateNow does it. Size rotation waits for it too.
+		r.due(now, pos)
+		rollover = false
+	} else if rollover {
+		r.seq = 0
+	} else if r.exceeds(len(data)) {
+		r.seq++
+		rollover = true
+	}
+
+	if !rollover && r.watchDeletion && r.buf.file && now.Sub(r.watched) >= defaultWatchInterval {
+		r.watched = now
+		if r.deleted() {
+			// Nothing to finalize, reopen the same destination.
+			r.fail(r.finish(r.buf))
+			r.buf = nil
+			rollover = true
+		}
+	}
+
+	if rollover {
+		if err := r.open(now, pos); err != nil {
+			if r.queue == nil {
+				// In async mode, consume reports every failed write.
+				r.fail(err)
+			}
+			return 0, false, err
+		}
+	}
+
+	n, err = r.bufferWrite(data)
+	r.buf.size += int64(n)
+	r.counters.bytesWritten.Add(int64(n))
+	if err == nil && r.unbuffered {
+		err = r.buf.Flush()
+	}
+	if r.flushOnIdle > 0 {
+		r.resetIdle()
+	}
+	if r.prewarm {
+		r.warmUp(now, pos)
+	}
+	if r.highWaterMark > 0 && r.onHighWater != nil {
+		if buffered := r.buffered(); buffered > r.highWaterMark {
+			r.highWater = buffered
+		}
+	}
+	switch {
+	case r.transform == nil:
+		if n > len(p) {
+			// The appended newline is not part of p.
+			n = len(p)
+		}
+	case err == nil:
+		// Callers see p consumed, whatever the length of the transformed data.
+		n = len(p)
+	default:
+		// Which part of p the transformed bytes written stand for is unknown.
+		n = 0
+	}
+	return n, rollover, err
+}
+
+// open opens the destination of now at position pos and makes it current, retiring the previous
+// one. The caller must hold the write lock.
+func (r *Rollout) open(now time.Time, pos int64) error {
+	dest, err := r.destination(now)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if r.fileBuffer {
+		if dest, size, err = r.resume(now, dest); err != nil {
+			return err
+		}
+	}
+
+	buf := r.takeWarm(dest, pos)
+	if buf == nil {
+		buf, err = r.bufferFunc(BufferConfig{
+			Dest:          dest,
+			Size:          r.bufferSize,
+			MaxBufferSize: r.maxBufferSize,
+			Interval:      r.flushInterval,
+			Mode:          r.fileMode,
+			DirMode:       r.dirMode,
+			Time:          now,
+			Seq:           r.seq,
+		})
 		if err != nil {
-			return 0, err
+			if rootErr := r.checkRoot(); r.fileBuffer && rootErr != nil {
+				return rootErr
+			}
+			return err
+		}
+	}
+	if s, ok := buf.(Sizer); ok && !r.fileBuffer {
+		// The built-in file buffer's size was found by resume already.
+		size = s.Size()
+	}
+
+	if header := r.header(dest, now); len(header) > 0 && fresh(buf) {
+		n, err := buf.Write(header)
+		if err != nil {
+			buf.Close()
+			return err
+		}
+		size += int64(n)
+		r.counters.bytesWritten.Add(int64(n))
+	}
+
+	var old *rolloutBuffer
+	old, r.buf = r.buf, &rolloutBuffer{Buffer: buf, pos: pos, dest: dest, size: size, file: r.fileBuffer}
+	r.watched = now
+	if r.onRotate != nil {
+		r.opened = append(r.opened, RotationEvent{New: dest, Time: now})
+	}
+
+	if old != nil {
+		r.counters.rotations.Add(1)
+		// Writes carry on in the new destination even if the old one, with the data it still
+		// buffered, fails to close, for example when the disk is full.
+		if err := r.retire(old); err != nil {
+			r.fail(&os.PathError{Op: "close", Path: old.dest, Err: err})
+		}
+		r.emit(RotationEvent{Old: old.dest, New: dest, Time: now})
+	}
+
+	if r.fileBuffer {
+		if r.symlink != "" {
+			r.fail(symlink(dest, r.symlink))
+		}
+		r.fail(r.rotate())
+	}
+	return nil
+}
+
+// deleted tells whether the destination of the current file buffer was deleted or replaced. The
+// caller must hold the write lock.
+func (r *Rollout) deleted() bool {
+	fb, ok := r.buf.Buffer.(*FileBuffer)
+	if !ok {
+		return false
+	}
+	info, err := fb.f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(r.buf.dest)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && !os.SameFile(info, current)
+}
+
+// checkRoot returns ErrRootNotDirectory if Root exists but is not a directory. A missing Root
+// is fine, it is created along with the first destination.
+func (r *Rollout) checkRoot() error {
+	if r.root == "" {
+		return nil
+	}
+	info, err := os.Stat(r.root)
+	if err == nil && !info.IsDir() {
+		return ErrRootNotDirectory
+	}
+	return nil
+}
+
+// freshBuffer is implemented by buffers telling whether their destination was empty when opened.
+type freshBuffer interface {
+	Fresh() bool
+}
+
+// fresh reports whether buf starts an empty destination. Buffers not telling are assumed fresh.
+func fresh(buf Buffer) bool {
+	if f, ok := buf.(freshBuffer); ok {
+		return f.Fresh()
+	}
+	return true
+}
+
+// header returns the header of the new destination dest, opened at t.
+func (r *Rollout) header(dest string, t time.Time) []byte {
+	if r.headerFunc != nil {
+		return r.headerFunc(dest, t)
+	}
+	return r.headerBytes
+}
+
+// footer returns the footer of the destination dest, closed now.
+func (r *Rollout) footer(dest string) []byte {
+	if r.footerFunc != nil {
+		return r.footerFunc(dest, r.clock())
+	}
+	return r.footerBytes
+}
+
+// finish writes the footer to b and closes it. A buffer is finished only once.
+func (r *Rollout) finish(b *rolloutBuffer) error {
+	if b.finished {
+		return nil
+	}
+	b.finished = true
+
+	var err error
+	if footer := r.footer(b.dest); len(footer) > 0 {
+		var n int
+		n, err = b.Write(footer)
+		b.size += int64(n)
+		r.counters.bytesWritten.Add(int64(n))
+	}
+	if fb, ok := b.Buffer.(*FileBuffer); ok && r.removeEmpty && b.size == 0 && err == nil {
+		// Removed while still open, so other processes appending to it are noticed.
+		b.removed, err = fb.removeIfEmpty(b.dest)
+	}
+	if cerr := b.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// retire closes a buffer replaced by a new one, then renames and compresses its destination in
+// background. The caller must hold the write lock.
+func (r *Rollout) retire(b *rolloutBuffer) error {
+	err := r.finish(b)
+	if r.finalizes(b) {
+		r.finalizing.Add(1)
+		go func() {
+			defer r.finalizing.Done()
+			if err := r.finalize(b); err != nil {
+				r.report(err)
+			}
+		}()
+	}
+	return err
+}
+
+// newFileBuffer is the BufferFunc2 of the built-in file buffer.
+func (r *Rollout) newFileBuffer(c BufferConfig) (Buffer, error) {
+	interval := c.Interval
+	if r.unbuffered {
+		// Every write is flushed already.
+		interval = 0
+	}
+	b, err := newFileBuffer(c.Dest, c.Size, interval, fileOptions{
+		mode:        c.Mode,
+		dirMode:     c.DirMode,
+		onError:     r.report,
+		onFlush:     r.countFlush,
+		sync:        r.sync,
+		syncOnClose: r.syncOnRotate,
+		ticker:      r.ticker,
+		lock:        r.lock,
+		sharedFlush: r.sharedFlush,
+		maxBuffer:   c.MaxBufferSize,
+		jitter:      r.flushJitter,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// finalize renames and compresses a destination of the file buffer after it is closed, then runs
+// PostRotate.
+func (r *Rollout) finalize(b *rolloutBuffer) error {
+	name := b.dest
+	if b.file && r.renameFunc != nil {
+		if to := r.renameFunc(name); to != "" && to != name {
+			if err := os.MkdirAll(filepath.Dir(to), r.dirMode); err != nil {
+				return err
+			}
+			if err := os.Rename(name, to); err != nil {
+				return err
+			}
+			name = to
+		}
+	}
+
+	if b.file && r.compress {
+		if err := compressFile(name, r.compressSuffix, r.compressor); err != nil {
+			return &os.PathError{Op: "compress", Path: name, Err: err}
+		}
+		name += r.compressSuffix
+	}
+
+	if r.postRotate != nil {
+		return r.postRotate(name)
+	}
+	return nil
+}
+
+// finalizes tells whether the closed buffer b needs finalize.
+func (r *Rollout) finalizes(b *rolloutBuffer) bool {
+	if b.removed {
+		return false
+	}
+	return b.file && (r.compress || r.renameFunc != nil) || r.postRotate != nil
+}
+
+// fail records err to be reported once the write lock is released. The caller must hold the
+// write lock. A nil err is ignored.
+func (r *Rollout) fail(err error) {
+	if err != nil {
+		r.errs = append(r.errs, err)
+	}
+}
+
+// unlock releases the write lock, then reports errors recorded while holding it, and calls the
+// callbacks of destinations opened meanwhile.
+func (r *Rollout) unlock() {
+	if callbacks := r.release(); callbacks != nil {
+		callbacks()
+	}
+}
+
+// release releases the write lock like unlock, but returns the callbacks due instead of calling
+// them, nil if there are none.
+func (r *Rollout) release() func() {
+	errs := r.errs
+	r.errs = nil
+	highWater := r.highWater
+	r.highWater = 0
+	opened := r.opened
+	r.opened = nil
+	r.mux.Unlock()
+
+	if len(errs) == 0 && highWater == 0 && len(opened) == 0 {
+		return nil
+	}
+	return func() {
+		for _, e := range opened {
+			r.onRotate(e.New, e.Time)
+		}
+		for _, err := range errs {
+			r.report(err)
+		}
+		if highWater > 0 {
+			r.onHighWater(highWater)
 		}
+	}
+}
+
+// report passes err to the OnError callback.
+func (r *Rollout) report(err error) {
+	if r.onError != nil {
+		r.onError(err)
+	}
+	select {
+	case r.errCh <- err:
+	default:
+	}
+}
 
-		var old *rolloutBuffer
-		old, r.buf = r.buf, &rolloutBuffer{buf, pos}
+// resume looks at an existing file at dest, left by a previous run in the same period. When such
+// a file has already reached MaxSize, Seq is incremented until a destination with room is found.
+// It returns the destination to open and its current size.
+func (r *Rollout) resume(t time.Time, dest string) (string, int64, error) {
+	for {
+		info, err := os.Stat(dest)
+		if err != nil {
+			return dest, 0, nil
+		}
+		if r.maxSize <= 0 || info.Size() < r.maxSize {
+			return dest, info.Size(), nil
+		}
 
-		if old != nil {
-			old.Close()
+		r.seq++
+		next, err := r.destination(t)
+		if err != nil {
+			return "", 0, err
+		}
+		if next == dest {
+			// Template doesn't use Seq, appending is the only option.
+			return dest, info.Size(), nil
 		}
+		dest = next
 	}
+}
 
-	return r.buf.Write(p)
+// exceeds reports whether writing n more bytes would grow the current buffer beyond MaxSize.
+// An empty buffer never exceeds, so a single large write still lands in one destination.
+func (r *Rollout) exceeds(n int) bool {
+	return r.maxSize > 0 && r.buf.size > 0 && r.buf.size+int64(n) > r.maxSize
 }
 
-// Flush writes buffered data to current file.
+// Flush writes buffered data to current file. It returns ErrClosed after Close.
 func (r *Rollout) Flush() error {
 	r.mux.RLock()
 	defer r.mux.RUnlock()
 
+	if r.closed {
+		return ErrClosed
+	}
 	if r.buf == nil {
 		return nil
 	}
-	return r.buf.Flush()
+	if err := r.waitInflight(); err != nil {
+		return err
+	}
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+	r.counters.flushes.Add(1)
+	return nil
 }
 
-// Close the writer. There may be data present in current buffer when main goroutine
-// quits. Such data will lost if you don't flush it to the underlying writer. Close
-// will flushes any data in the buffer to current logging file and then closes the file
-// descriptor. So make sure Rollout is closed before main goroutine quits.
-func (r *Rollout) Close() error {
+// syncer is implemented by buffers able to commit flushed data to stable storage, like FileBuffer.
+type syncer interface {
+	Sync() error
+}
+
+// syncBuffer flushes b, then syncs it if it can.
+func syncBuffer(b Buffer) error {
+	if s, ok := b.(syncer); ok {
+		return s.Sync()
+	}
+	return b.Flush()
+}
+
+// Sync flushes the current buffer and commits the destination to stable storage, for durability
+// at chosen checkpoints without Sync on every flush. For buffers unable to sync, it is the same
+// as Flush. It returns ErrClosed after Close.
+func (r *Rollout) Sync() error {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if r.buf == nil {
+		return nil
+	}
+	if err := r.waitInflight(); err != nil {
+		return err
+	}
+	if err := syncBuffer(r.buf.Buffer); err != nil {
+		return err
+	}
+	r.counters.flushes.Add(1)
+	return nil
+}
+
+// flushAtInterval calls Flush every flush interval until Rollout is closed.
+func (r *Rollout) flushAtInterval() {
+	defer r.flushing.Done()
+
+	ticker := r.ticker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.flushDone:
+			return
+		case <-ticker.Chan():
+			if err := r.Flush(); err != nil && err != ErrClosed {
+				r.report(err)
+			}
+		}
+	}
+}
+
+// resetIdle restarts the idle flush timer. The caller must hold the write lock.
+func (r *Rollout) resetIdle() {
+	if r.idleTimer == nil {
+		r.idleTimer = time.AfterFunc(r.flushOnIdle, r.flushIdle)
+		return
+	}
+	r.idleTimer.Reset(r.flushOnIdle)
+}
+
+// flushIdle calls Flush when writes stopped for FlushOnIdle.
+func (r *Rollout) flushIdle() {
+	if err := r.Flush(); err != nil && err != ErrClosed {
+		r.report(err)
+	}
+}
+
+// Reopen flushes and closes the current buffer, a new one is opened at the destination on next
+// Write. It is useful when the file is moved by external tools like logrotate, call it on SIGHUP.
+func (r *Rollout) Reopen() error {
 	r.mux.Lock()
-	defer r.mux.Unlock()
+	defer r.unlock()
 
 	if r.closed {
+		return ErrClosed
+	}
+	if r.buf == nil {
 		return nil
 	}
+	if err := r.awaitInflight(); err != nil {
+		return err
+	}
 
-	r.closed = true
+	buf := r.buf
+	r.buf = nil
+	return r.finish(buf)
+}
+
+// RotateNow starts a new destination immediately, whatever the time is. The current one is
+// rotated out, and the new one is opened within the same period with Seq incremented, so the
+// template needs `{{.Seq}}` to tell them apart. Without it, the same destination is reopened.
+func (r *Rollout) RotateNow() error {
+	r.mux.Lock()
+	defer r.unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if err := r.awaitInflight(); err != nil {
+		return err
+	}
+
+	now := r.clock()
+	pos := r.position(now)
+	if r.buf != nil && r.buf.pos == pos {
+		r.seq++
+	} else {
+		r.seq = 0
+	}
+	return r.open(now, pos)
+}
+
+// Reconfigure changes the destination of a live Rollout. The Template, TimeFormat, Root and
+// Rotation of options are applied, taking defaults for zero values like New does. A BufferFunc2
+// or BufferFunc replaces the current buffer, for example NewDiscardBuffer turns logging off, and
+// its destinations are then no longer compressed, renamed or watched for deletion. Without both,
+// the built-in file buffer is used again, with the FileMode, Compress, RenameFunc, Symlink, Lock,
+// Sync and retention New was given. Other fields are ignored. The current buffer is closed as if rotated out, the next Write opens the new
+// destination. An invalid template is returned as error and nothing is changed.
+func (r *Rollout) Reconfigure(options Options) error {
+	tpl, err := parseTemplate(options.Template, options.SafeDefault)
+	if err != nil {
+		return err
+	}
+
+	if options.TimeFormat == "" {
+		options.TimeFormat = defaultTimeFormat
+	}
+	if options.Rotation <= 0 {
+		options.Rotation = RotateDaily
+	}
+
+	r.mux.Lock()
+	defer r.unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if err := r.awaitInflight(); err != nil {
+		return err
+	}
+
+	r.template = tpl
+	r.timeFormat = options.TimeFormat
+	r.root = options.Root
+	r.interval = options.Rotation
+	r.generation++
+	switch {
+	case options.BufferFunc2 != nil:
+		r.bufferFunc = options.BufferFunc2
+		r.fileBuffer = false
+	case options.BufferFunc != nil:
+		r.bufferFunc = bufferFunc2(options.BufferFunc)
+		r.fileBuffer = false
+	default:
+		r.bufferFunc = r.newFileBuffer
+		r.fileBuffer = true
+	}
+	r.fail(r.discardWarm())
 
 	if r.buf == nil {
 		return nil
 	}
-	return r.buf.Close()
+	buf := r.buf
+	r.buf = nil
+	return r.retire(buf)
 }
 
-// Rotate TODO: delete old files
-// func (r *Rollout) Rotate() error {
-// 	return nil
-// }
+// CurrentFile returns the destination of the current buffer, or its name if the buffer
+// implements Named. It returns an empty string if no buffer is opened yet.
+func (r *Rollout) CurrentFile() string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.buf == nil {
+		return ""
+	}
+	if b, ok := r.buf.Buffer.(Named); ok {
+		return b.Name()
+	}
+	return r.buf.dest
+}
+
+// sizedBuffer is implemented by buffers telling how much data they hold, like FileBuffer.
+type sizedBuffer interface {
+	Buffered() int
+	Available() int
+}
+
+// Buffered returns the number of bytes held in the current buffer, not yet written to the
+// destination. It is 0 if no buffer is opened, or the buffer doesn't tell.
+func (r *Rollout) Buffered() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.buffered()
+}
+
+// buffered does the work of Buffered. The caller must hold the lock.
+func (r *Rollout) buffered() int {
+	if r.buf == nil || r.busy() {
+		return 0
+	}
+	if b, ok := r.buf.Buffer.(sizedBuffer); ok {
+		return b.Buffered()
+	}
+	return 0
+}
+
+// Available returns how many bytes are unused in the current buffer. It is 0 if no buffer is
+// opened, or the buffer doesn't tell.
+func (r *Rollout) Available() int {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.buf == nil || r.busy() {
+		return 0
+	}
+	if b, ok := r.buf.Buffer.(sizedBuffer); ok {
+		return b.Available()
+	}
+	return 0
+}
+
+// Destination returns the destination Write would open at t, with the current Seq. It doesn't
+// touch the file system, so it is handy to validate templates or prepare directories. An error is
+// returned if the template fails to execute.
+func (r *Rollout) Destination(t time.Time) (string, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.destination(t)
+}
+
+// Position returns the index of the Rotation period containing t. Times in the same period share
+// a destination.
+func (r *Rollout) Position(t time.Time) int64 {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	return r.position(t)
+}
+
+// Close the writer. There may be data present in current buffer when main goroutine
+// quits. Such data will lost if you don't flush it to the underlying writer. Close
+// will flushes any data in the buffer to current logging file and then closes the file
+// descriptor. So make sure Rollout is closed before main goroutine quits. With Compress or
+// RenameFunc, the current destination is finalized like a rotated out one, and Close waits for
+// the rotated out ones still being finalized in background.
+func (r *Rollout) Close() error {
+	return r.CloseContext(context.Background())
+}
 
-func (r *Rollout) position(t time.Time) int {
-	timestamp := int(t.Unix())
+// Wait blocks until destinations rotated out so far are renamed and compressed. Finalization runs
+// in background, so a program exiting right after rotation may otherwise leave temporary files.
+func (r *Rollout) Wait() {
+	r.finalizing.Wait()
+}
+
+// CloseContext closes the writer like Close, but stops waiting for the buffer to close when
+// ctx is done, returning ctx.Err(). The writer is marked closed anyway, and the buffer keeps
+// closing in background. It bounds the shutdown time when the underlying writer blocks.
+//
+// In async mode, queued data is written before the buffer is closed, and waiting for it is
+// bounded by ctx as well. So is waiting CloseGrace.
+func (r *Rollout) CloseContext(ctx context.Context) error {
+	// Producers watching Closing may still write until the Rollout is marked closed.
+	r.closingOnce.Do(func() { close(r.closing) })
+	if r.closeGrace > 0 {
+		grace := time.NewTimer(r.closeGrace)
+		select {
+		case <-grace.C:
+		case <-ctx.Done():
+			grace.Stop()
+		}
+	}
+
+	r.mux.Lock()
+	if r.closed {
+		r.mux.Unlock()
+		return nil
+	}
+	r.closed = true
+	if r.idleTimer != nil {
+		r.idleTimer.Stop()
+	}
+	r.mux.Unlock()
+
+	if r.flushDone != nil {
+		close(r.flushDone)
+	}
+	if r.queue != nil {
+		r.queue.close()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		r.flushing.Wait()
+		if r.queue != nil {
+			<-r.queue.done
+			<-r.queue.notified
+		}
+
+		r.mux.Lock()
+		buf := r.buf
+		inflight := r.inflight
+		r.closeEvents()
+		warmErr := r.discardWarm()
+		r.mux.Unlock()
+
+		if inflight != nil {
+			<-inflight
+		}
+
+		var err error
+		if buf != nil {
+			err = r.finish(buf)
+			if err == nil && r.finalizes(buf) {
+				err = r.finalize(buf)
+			}
+		}
+		r.warmups.Wait()
+		r.finalizing.Wait()
+		if err == nil {
+			err = warmErr
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// position returns the index of the Rotation period containing t. It is an int64 so times past
+// 2038 don't wrap on 32-bit platforms.
+func (r *Rollout) position(t time.Time) int64 {
+	timestamp := t.Unix()
 	if r.interval >= RotateDaily {
-		timestamp += r.zoneOffset
+		timestamp += int64(r.offset(t))
+	}
+	// Round toward negative infinity, so pre-epoch times share periods like later ones do.
+	interval := int64(r.interval)
+	position := timestamp / interval
+	if timestamp%interval < 0 {
+		position--
+	}
+	return position
+}
+
+// offset returns the zone offset in seconds at t, which aligns daily or longer periods to
+// local midnight. It is looked up for every t, a cached offset would be an hour off across
+// daylight saving time changes.
+func (r *Rollout) offset(t time.Time) int {
+	_, offset := r.localTime(t).Zone()
+	return offset
+}
+
+// periodStart returns the beginning of the Rotation period containing t.
+func (r *Rollout) periodStart(t time.Time) time.Time {
+	return r.positionTime(r.position(t), t)
+}
+
+// periodEnd returns the end of the Rotation period containing t, where the next one begins.
+func (r *Rollout) periodEnd(t time.Time) time.Time {
+	return r.positionTime(r.position(t)+1, t)
+}
+
+// positionTime returns the beginning of the period at position pos, in the location of t.
+func (r *Rollout) positionTime(pos int64, t time.Time) time.Time {
+	timestamp := pos * int64(r.interval)
+	if r.interval < RotateDaily {
+		return time.Unix(timestamp, 0).In(t.Location())
 	}
-	return timestamp / r.interval
+
+	// The position counts periods of local time, convert the wall clock back to an instant.
+	wall := time.Unix(timestamp, 0).UTC()
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, r.localTime(t).Location())
 }
 
-func (r *Rollout) destination(t time.Time) string {
+func (r *Rollout) destination(t time.Time) (string, error) {
+	return r.render(r.templateData(t))
+}
+
+// render executes the template with data into a path in Root.
+func (r *Rollout) render(data map[string]interface{}) (string, error) {
 	buf := new(bytes.Buffer)
-	r.template.Execute(buf, map[string]interface{}{
-		"Pid":  pid,
-		"Host": host,
-		"Time": t.Format(r.timeFormat),
-	})
-	return filepath.Join(r.root, buf.String())
+	if err := r.template.Execute(buf, data); err != nil {
+		return "", &TemplateError{err}
+	}
+	name := buf.String()
+	if r.sanitize {
+		name = sanitizeFilename(name)
+	}
+	dest := filepath.Join(r.root, filepath.FromSlash(name))
+
+	// Fields may come from users, the destination must be a file within Root.
+	if strings.TrimSpace(name) == "" || !r.within(dest) {
+		return "", &os.PathError{Op: "destination", Path: name, Err: ErrInvalidDestination}
+	}
+	return dest, nil
+}
+
+// within tells whether dest is a path inside Root, other than Root itself.
+func (r *Rollout) within(dest string) bool {
+	if r.root == "" {
+		return dest != "."
+	}
+	rel, err := filepath.Rel(r.root, dest)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// filenameReplacer replaces the characters not allowed in Windows file names.
+var filenameReplacer = strings.NewReplacer(
+	":", "-",
+	"<", "_",
+	">", "_",
+	`"`, "_",
+	"|", "_",
+	"?", "_",
+	"*", "_",
+)
+
+// sanitizeFilename replaces the characters not allowed in Windows file names. Separators are kept.
+func sanitizeFilename(name string) string {
+	return filenameReplacer.Replace(name)
 }
+
+// localTime returns t in Location, or t itself if Location is not set.
+func (r *Rollout) localTime(t time.Time) time.Time {
+	if r.location != nil {
+		return t.In(r.location)
+	}
+	return t
+}
+
+// templateData returns the variables available to the destination template at time t.
+func (r *Rollout) templateData(t time.Time) map[string]interface{} {
+	start := r.periodStart(t)
+	data := make(map[string]interface{}, len(r.fields)+len(reservedFields))
+	for k, v := range r.fields {
+		data[k] = v
+	}
+	data["Fields"] = r.fields
+	data["Pid"] = r.pid
+	data["Run"] = r.run
+	data["Shard"] = r.shard
+	data["StartTime"] = r.startTime
+	data["Host"] = r.host
+	data["Time"] = r.localTime(t).Format(r.timeFormat)
+	data["Seq"] = r.seq
+	data["Unix"] = start.Unix()
+	data["Nano"] = start.UnixNano()
+	return data
+}
+
+// reservedFields are the template variables Fields can't override.
+var reservedFields = []string{"Fields", "Pid", "Run", "StartTime", "Shard", "Host", "Time", "Seq", "Unix", "Nano"}
@@ -1,9 +1,23 @@
 package rollout
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -16,6 +30,38 @@ func TestNewRolloutDefaultOptions(t *testing.T) {
 	assert.Equal(t, RotateDaily, r.interval, "default rotation interval should be daily")
 	assert.Equal(t, 10*time.Second, r.flushInterval, "default flushing interval should be 10s")
 	assert.Equal(t, defaultTimeFormat, r.timeFormat, "default time format should match")
+	assert.Equal(t, defaultKeeps, r.keeps, "default keeps should match")
+	assert.Equal(t, os.FileMode(defaultFileMode), r.fileMode, "default file mode should match")
+}
+
+func TestNewWithError(t *testing.T) {
+	r, err := NewWithError(Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, RotateDaily, r.interval, "zero values should take defaults")
+
+	cases := []Options{
+		{Template: "test-{{.Time}.log"},
+		{Template: "test-{{.Foo}}.log"},
+		{Rotation: -1},
+		{BufferSize: -1},
+		{Flush: -1},
+		{MaxSize: -1},
+		{CompressLevel: 10},
+	}
+	for _, c := range cases {
+		r, err := NewWithError(c)
+		assert.Error(t, err, "options %+v should be invalid", c)
+		assert.Nil(t, r)
+	}
+
+	r = New(Options{Template: "test-{{.Time}.log"})
+	assert.Equal(t, defaultDestTamplate, r.template.Root.String(), "New should fall back to the default template")
+
+	r = New(Options{SafeDefault: true, Pid: 42, Location: time.UTC})
+	dest, _ := r.destination(time.Date(2017, time.November, 5, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "rollout-2017-11-05-42.log", dest, "safe default template should include pid")
+	r = New(Options{Template: "test-{{.Time}.log", SafeDefault: true})
+	assert.Equal(t, defaultSafeTemplate, r.template.Root.String(), "New should fall back to the safe default template")
 }
 
 type MockBuffer struct {
@@ -82,6 +128,232 @@ func TestRolloutWrite(t *testing.T) {
 	assert.Zero(t, n, "write byte should be zero")
 }
 
+func TestRolloutOnError(t *testing.T) {
+	root := t.TempDir()
+	notDir := filepath.Join(root, "file")
+	assert.NoError(t, os.WriteFile(notDir, nil, 0644))
+
+	var errs []error
+	r := New(Options{
+		Root: notDir,
+		OnError: func(err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	_, err := r.Write([]byte("any"))
+	assert.Error(t, err, "write should fail to open destination")
+	assert.Equal(t, []error{err}, errs, "open error should be reported")
+}
+
+func TestRolloutOnErrorSymlink(t *testing.T) {
+	root := t.TempDir()
+
+	var errs []error
+	r := New(Options{
+		Root:    root,
+		Symlink: "missing/current.log",
+		OnError: func(err error) {
+			errs = append(errs, err)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("any"))
+	assert.NoError(t, err, "symlink failure should not fail write")
+	assert.Len(t, errs, 1, "symlink failure should be reported")
+}
+
+func TestRolloutAsync(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "test.log",
+		Async:    true,
+	})
+
+	for i := 0; i < 100; i++ {
+		n, err := r.Write([]byte("0123456789\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, 11, n, "write should report all bytes queued")
+	}
+	assert.NoError(t, r.Close())
+
+	info, err := os.Stat(filepath.Join(root, "test.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1100), info.Size(), "close should write all queued data")
+
+	_, err = r.Write([]byte("any"))
+	assert.Equal(t, ErrClosed, err, "write to closed writer should return error")
+
+	notDir := filepath.Join(root, "test.log")
+	errs := make(chan error, 1)
+	r = New(Options{
+		Root:  notDir,
+		Async: true,
+		OnError: func(err error) {
+			errs <- err
+		},
+	})
+	_, err = r.Write([]byte("any"))
+	assert.NoError(t, err, "async write should not wait for the destination")
+	r.Close()
+	assert.Error(t, <-errs, "open error should be reported")
+}
+
+func TestRolloutDrain(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "test.log")
+	r := New(Options{
+		Root:     root,
+		Template: "test.log",
+		Async:    true,
+	})
+
+	for i := 0; i < 100; i++ {
+		r.Write([]byte("0123456789\n"))
+	}
+	assert.NoError(t, r.Drain())
+	info, err := os.Stat(name)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1100), info.Size(), "queued data should be written")
+
+	r.Close()
+	assert.Equal(t, ErrClosed, r.Drain(), "drain closed writer should return error")
+
+	r = New(Options{Root: root, Template: "test.log"})
+	r.Write([]byte("sync\n"))
+	assert.NoError(t, r.Drain())
+	info, _ = os.Stat(name)
+	assert.Equal(t, int64(1105), info.Size(), "drain should flush in sync mode")
+	r.Close()
+}
+
+func TestRolloutSync(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{Root: root, Template: "test.log"})
+	assert.NoError(t, r.Sync(), "sync without buffer should do nothing")
+
+	r.Write([]byte("123"))
+	assert.NoError(t, r.Sync())
+	content, _ := os.ReadFile(filepath.Join(root, "test.log"))
+	assert.Equal(t, "123", string(content), "data should be flushed")
+	r.Close()
+	assert.Equal(t, ErrClosed, r.Sync(), "sync closed writer should return error")
+
+	buf := new(bytes.Buffer)
+	r = New(Options{BufferFunc: MultiBuffer(NewWriterBuffer(buf))})
+	r.Write([]byte("456"))
+	assert.NoError(t, r.Sync(), "buffer unable to sync should be flushed")
+	assert.Equal(t, "456", buf.String())
+	r.Close()
+}
+
+func TestRolloutRootNotDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(root, nil, 0644)
+
+	_, err := NewWithError(Options{Root: root})
+	assert.Equal(t, ErrRootNotDirectory, err, "root should be checked on creation")
+
+	r := New(Options{Root: root})
+	_, err = r.Write([]byte("123"))
+	assert.Equal(t, ErrRootNotDirectory, err, "root should be checked on open failure")
+	r.Close()
+
+	_, err = NewWithError(Options{Root: filepath.Join(t.TempDir(), "missing")})
+	assert.NoError(t, err, "missing root should be created later")
+}
+
+func TestRolloutTail(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{Root: root, Template: "test.log"})
+	tail, err := r.Tail(2)
+	assert.NoError(t, err)
+	assert.Empty(t, tail, "tail without buffer should be empty")
+
+	r.Write([]byte("1\n2\n3\n"))
+	tail, err = r.Tail(2)
+	assert.NoError(t, err)
+	assert.Equal(t, "2\n3\n", string(tail), "last lines should be read")
+	tail, _ = r.Tail(5)
+	assert.Equal(t, "1\n2\n3\n", string(tail), "all lines should be read if there are fewer")
+
+	long := strings.Repeat("x", 3*tailChunkSize)
+	r.Write([]byte(long + "\n4"))
+	tail, _ = r.Tail(2)
+	assert.Equal(t, long+"\n4", string(tail), "lines should span chunks")
+	r.Close()
+	_, err = r.Tail(1)
+	assert.Equal(t, ErrClosed, err)
+
+	r = New(Options{BufferFunc: NewMockBuffer})
+	r.Write([]byte("1\n"))
+	_, err = r.Tail(1)
+	assert.Equal(t, ErrTailUnsupported, err, "custom buffers should be unsupported")
+
+	actual := filepath.Join(root, "actual.log")
+	r = New(Options{
+		Root:     root,
+		Template: "other.log",
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			f, err := os.OpenFile(actual, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, err
+			}
+			return NewFileBufferFromFile(f, size, interval)
+		},
+	})
+	defer r.Close()
+	r.Write([]byte("5\n"))
+	tail, err = r.Tail(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "5\n", string(tail), "open file should be read rather than the destination")
+
+	assert.NoError(t, os.Rename(actual, filepath.Join(root, "moved.log")))
+	_, err = r.Tail(1)
+	assert.Equal(t, ErrTailMoved, err, "moved file should not be read by name")
+
+	assert.NoError(t, os.WriteFile(actual, []byte("other\n"), 0644))
+	_, err = r.Tail(1)
+	assert.Equal(t, ErrTailMoved, err, "another file under the name should not be read")
+}
+
+func TestRolloutAsyncCallbackWrites(t *testing.T) {
+	var r *Rollout
+	var once sync.Once
+	r = New(Options{
+		Template:   "test-{{.Seq}}.log",
+		MaxSize:    1,
+		BufferFunc: NewMockBuffer,
+		Async:      true,
+		QueueSize:  1,
+		OnRotate: func(newPath string, at time.Time) {
+			// Enough writes to fill the queue, which only drains if callbacks run elsewhere.
+			once.Do(func() {
+				for i := 0; i < 10; i++ {
+					r.Write([]byte("rotated"))
+				}
+			})
+		},
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			r.Write([]byte("data"))
+		}
+		r.Drain()
+		r.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback writing to a full queue should not deadlock")
+	}
+}
+
 func TestRolloutFlush(t *testing.T) {
 	r := New(Options{
 		BufferFunc: NewMockBuffer,
@@ -95,74 +367,2320 @@ func TestRolloutFlush(t *testing.T) {
 	mb.AssertNumberOfCalls(t, "Flush", 2)
 }
 
-func TestRolloutClose(t *testing.T) {
+func TestRolloutBufferFunc2(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+	var configs []BufferConfig
+
 	r := New(Options{
-		BufferFunc: NewMockBuffer,
+		Template:   "test-{{.Seq}}.log",
+		MaxSize:    5,
+		BufferSize: 10,
+		Flush:      2,
+		FileMode:   0600,
+		Clock: func() time.Time {
+			return now
+		},
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			t.Fatal("BufferFunc2 should take precedence")
+			return nil, nil
+		},
+		BufferFunc2: func(c BufferConfig) (Buffer, error) {
+			configs = append(configs, c)
+			return &MockBuffer{}, nil
+		},
 	})
-	assert.Nil(t, r.buf, "buf should be nil if there is no write")
+	r.Write([]byte("1234"))
+	r.Write([]byte("1234"))
+
+	assert.Equal(t, []BufferConfig{
+		{Dest: "test-0.log", Size: 10, Interval: 2 * time.Second, Mode: 0600, DirMode: defaultDirMode, Time: now, Seq: 0},
+		{Dest: "test-1.log", Size: 10, Interval: 2 * time.Second, Mode: 0600, DirMode: defaultDirMode, Time: now, Seq: 1},
+	}, configs, "buffers should be created with full config")
+}
+
+func TestRolloutInvalidDestination(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		root     string
+		template string
+		fields   map[string]interface{}
+	}{
+		{"", "{{.name}}", map[string]interface{}{"name": ""}},
+		{"", " ", nil},
+		{"logs", "{{.name}}", map[string]interface{}{"name": "."}},
+		{"logs", "{{.name}}.log", map[string]interface{}{"name": "../../etc/passwd"}},
+		{"/var/log", "../{{.name}}", map[string]interface{}{"name": "x.log"}},
+	}
+	for _, c := range cases {
+		r := New(Options{Root: c.root, Template: c.template, Fields: c.fields, BufferFunc: NewMockBuffer})
+		_, err := r.destination(now)
+		assert.True(t, errors.Is(err, ErrInvalidDestination), "%q in %q should be invalid", c.template, c.root)
+
+		_, err = r.Write([]byte("any"))
+		assert.True(t, errors.Is(err, ErrInvalidDestination), "write should fail")
+	}
+
+	r := New(Options{Root: "logs", Template: "a/../b/{{.Time}}.log"})
+	_, err := r.destination(now)
+	assert.NoError(t, err, "paths within root should be valid")
+}
+
+func TestRolloutExportedDestination(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.UTC)
+	r := New(Options{Root: "logs", Location: time.UTC, BufferFunc: NewMockBuffer})
+
+	dest, err := r.Destination(now)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("logs", "rollout-2017-11-05.log"), dest, "destination should match")
+	assert.Equal(t, r.Position(now), r.Position(now.Add(11*time.Hour)), "same day should share position")
+	assert.Equal(t, r.Position(now)+1, r.Position(now.Add(12*time.Hour)), "next day should be next position")
+
+	r = New(Options{Template: "{{.Missing}}.log", BufferFunc: NewMockBuffer})
+	_, err = r.Destination(now)
+	var terr *TemplateError
+	assert.True(t, errors.As(err, &terr), "template error should be returned")
+}
+
+func TestRolloutRateLimit(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+	buf := new(strings.Builder)
+	r := New(Options{
+		MaxBytesPerSecond: 10,
+		BufferFunc:        NewWriterBuffer(buf),
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	for _, line := range []string{"1234", "5678", "abc"} {
+		n, err := r.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n, "dropped write should be reported written")
+	}
+	now = now.Add(500 * time.Millisecond)
+	r.Write([]byte("90"))
+	r.Write([]byte("12345678901234"))
+	now = now.Add(time.Second)
+	r.Write([]byte("12345678901234"))
 	r.Close()
 
+	assert.Equal(t, "123456789012345678901234", buf.String(), "excess writes should be dropped")
+	assert.Equal(t, int64(2), r.Stats().Dropped, "dropped writes should be counted")
+
+	buf.Reset()
 	r = New(Options{
-		BufferFunc: NewMockBuffer,
+		MaxBytesPerSecond: 1000,
+		RateLimitBlock:    true,
+		BufferFunc:        NewWriterBuffer(buf),
 	})
-	r.Write([]byte("any"))
-	mb := r.buf.Buffer.(*MockBuffer)
-	r.Close()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		r.Write([]byte(strings.Repeat("x", 500)))
+	}
 	r.Close()
-	mb.AssertNumberOfCalls(t, "Close", 1)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond, "excess writes should wait")
+	assert.Equal(t, 1500, buf.Len(), "blocked writes should not be dropped")
+	assert.Zero(t, r.Stats().Dropped)
+}
 
-	assert.True(t, r.closed, "closed flag should be true")
+func TestRolloutHost(t *testing.T) {
+	now := time.Now()
+	name, _ := os.Hostname()
 
-	_, err := r.Write([]byte("test data"))
-	assert.Equal(t, ErrClosed, err, "write to closed writer should return error")
+	r := New(Options{Template: "{{.Host}}.log"})
+	dest, _ := r.destination(now)
+	assert.Equal(t, name+".log", dest, "host name should be readable by default")
+
+	r = New(Options{Template: "{{.Host}}.log", Host: "web-1"})
+	dest, _ = r.destination(now)
+	assert.Equal(t, "web-1.log", dest, "host should be overridden")
+
+	r = New(Options{Template: "{{.Host}}.log", Host: "web-1", HashHost: true})
+	dest, _ = r.destination(now)
+	assert.Equal(t, "ba92dbab2801178bcb56af5f2562eda9d2a3cf41.log", dest, "host should be hashed")
 }
 
-func TestRolloutPosition(t *testing.T) {
-	cases := []struct {
-		time     time.Time
-		interval int
-		position int
-	}{
-		{time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), 1, 0},
-		{time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), RotateMinutely, 0},
-		{time.Date(2017, time.November, 11, 14, 9, 27, 0, time.UTC), RotateMinutely, 25173489},
-		{time.Date(2017, time.November, 11, 14, 9, 27, 0, time.UTC), RotateDaily, 17481},
-		{time.Date(2017, time.November, 22, 0, 0, 0, 0, time.UTC), RotateDaily, 17492},
-		{time.Date(2017, time.November, 22, 0, 0, 0, 0, time.Local), RotateDaily, 17492},
+func TestRolloutFields(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+	fields := map[string]interface{}{"tenant": "acme", "env": "prod", "Time": "ignored"}
+
+	r := New(Options{Template: "{{.Fields.tenant}}/{{.env}}-{{.Time}}.log", Fields: fields})
+	dest, err := r.destination(now)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("acme", "prod-2017-11-05.log"), dest, "fields should be available in template")
+
+	_, err = NewWithError(Options{Fields: fields})
+	assert.EqualError(t, err, "rollout: field Time is reserved")
+
+	_, err = NewWithError(Options{Template: "{{.Fields.missing}}.log", Fields: fields})
+	assert.Error(t, err, "missing field should be an error")
+}
+
+func TestRolloutPid(t *testing.T) {
+	now := time.Now()
+
+	r := New(Options{Template: "{{.Pid}}.log"})
+	dest, _ := r.destination(now)
+	assert.Equal(t, fmt.Sprintf("%d.log", os.Getpid()), dest, "pid should be the process ID by default")
+
+	r = New(Options{Template: "{{.Host}}-{{.Pid}}.log", Host: "web-1", Pid: 42})
+	dest, _ = r.destination(now)
+	assert.Equal(t, "web-1-42.log", dest, "pid should be overridden")
+}
+
+func TestRolloutRun(t *testing.T) {
+	now := time.Now()
+
+	r := New(Options{Template: "{{.Run}}.log"})
+	dest, _ := r.destination(now)
+	assert.Equal(t, r.run+".log", dest, "run should be rendered")
+	assert.NotEmpty(t, r.run, "run should be generated")
+	later, _ := r.destination(now.Add(time.Hour))
+	assert.Equal(t, dest, later, "run should be stable")
+
+	next := New(Options{Template: "{{.Run}}.log"})
+	assert.Less(t, r.run, next.run, "later runs should get greater tokens")
+
+	r = New(Options{Template: "{{.Run}}.log", Run: "a"})
+	dest, _ = r.destination(now)
+	assert.Equal(t, "a.log", dest, "run should be overridden")
+}
+
+func TestRolloutStartTime(t *testing.T) {
+	start := time.Date(2017, time.November, 5, 12, 30, 15, 0, time.UTC)
+	r := New(Options{
+		Template: "{{.StartTime}}-{{.Time}}.log",
+		Clock:    func() time.Time { return start },
+		Location: time.UTC,
+	})
+	dest, _ := r.destination(start.Add(48 * time.Hour))
+	assert.Equal(t, "20171105T123015-2017-11-07.log", dest, "start time should be captured once")
+
+	r = New(Options{
+		Template:        "{{.StartTime}}.log",
+		StartTimeFormat: "150405",
+		Clock:           func() time.Time { return start },
+		Location:        time.UTC,
+	})
+	dest, _ = r.destination(start)
+	assert.Equal(t, "123015.log", dest, "start time format should be used")
+
+	_, err := NewWithError(Options{Fields: map[string]interface{}{"StartTime": "x"}})
+	assert.Error(t, err, "start time should be reserved")
+}
+
+func TestRolloutRotateRuns(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"app-2017-11-05-b-0.log", "app-2017-11-05-a-1.log", "app-2017-11-05-a-0.log"} {
+		os.WriteFile(filepath.Join(root, name), []byte("x"), 0644)
 	}
 
-	for _, c := range cases {
-		r := New(Options{
-			Rotation: c.interval,
-		})
+	r := New(Options{
+		Root:     root,
+		Template: "app-{{.Time}}-{{.Run}}-{{.Seq}}.log",
+		Run:      "c",
+	})
+	files, err := r.destinations()
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.path))
+	}
+	assert.Equal(t, []string{"app-2017-11-05-a-0.log", "app-2017-11-05-a-1.log", "app-2017-11-05-b-0.log"}, names,
+		"destinations of earlier runs should be ordered first")
+}
 
-		actual := r.position(c.time)
-		assert.Equal(t, c.position, actual, "position should match")
+func TestRolloutStats(t *testing.T) {
+	clock := func() Clock {
+		now := time.Now()
+		return func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+	}()
+
+	r := New(Options{
+		Clock:      clock,
+		BufferFunc: NewMockBuffer,
+		Rotation:   RotateSecondly,
+	})
+	r.Write([]byte("1234"))
+	r.Write([]byte("123"))
+	r.Flush()
+
+	assert.Equal(t, Stats{BytesWritten: 7, Flushes: 1, Rotations: 1}, r.Stats(), "stats should match")
+
+	r = New(Options{
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return nil, errors.New("test")
+		},
+	})
+	r.Write([]byte("1234"))
+	assert.Equal(t, Stats{WriteErrors: 1}, r.Stats(), "write error should be counted")
+
+	ticker := &fakeTicker{c: make(chan time.Time)}
+	r = New(Options{
+		Root:     t.TempDir(),
+		Template: "test.log",
+		Ticker:   func(d time.Duration) Ticker { return ticker },
+	})
+	defer r.Close()
+	r.Write([]byte("1234"))
+	// The second tick is received only after the first flush is done.
+	ticker.c <- time.Now()
+	ticker.c <- time.Now()
+	assert.Equal(t, int64(1), r.Stats().Flushes, "interval flushes should be counted")
+}
+
+func TestRolloutUnbuffered(t *testing.T) {
+	root := t.TempDir()
+	ticked := false
+	r := New(Options{
+		Root:       root,
+		Template:   "test.log",
+		Unbuffered: true,
+		Ticker: func(d time.Duration) Ticker {
+			ticked = true
+			return &fakeTicker{c: make(chan time.Time)}
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("123"))
+	content, _ := os.ReadFile(filepath.Join(root, "test.log"))
+	assert.Equal(t, "123", string(content), "data should be written immediately")
+	assert.False(t, ticked, "interval flushing of the file buffer should be disabled")
+
+	var interval time.Duration
+	r = New(Options{
+		Flush:      3,
+		Unbuffered: true,
+		BufferFunc: func(dest string, size int, i time.Duration) (Buffer, error) {
+			interval = i
+			return NewMockBuffer(dest, size, i)
+		},
+	})
+	defer r.Close()
+	r.Write([]byte("123"))
+	assert.Equal(t, 3*time.Second, interval, "custom buffers should be given the Flush interval")
+}
+
+func TestRolloutWatchDeletion(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "test.log")
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:          root,
+		Template:      "test.log",
+		WatchDeletion: true,
+		Unbuffered:    true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("1"))
+	assert.NoError(t, os.Remove(name))
+	r.Write([]byte("2"))
+	_, err := os.Stat(name)
+	assert.True(t, os.IsNotExist(err), "deletion should be checked at most once a second")
+
+	now = now.Add(2 * time.Second)
+	r.Write([]byte("3"))
+	content, _ := os.ReadFile(name)
+	assert.Equal(t, "3", string(content), "deleted destination should be recreated")
+
+	assert.NoError(t, os.Rename(name, name+".moved"))
+	assert.NoError(t, os.WriteFile(name, []byte("other\n"), 0644))
+	now = now.Add(2 * time.Second)
+	r.Write([]byte("4"))
+	content, _ = os.ReadFile(name)
+	assert.Equal(t, "other\n4", string(content), "replaced destination should be reopened")
+	assert.Zero(t, r.Stats().Rotations, "reopening is not a rotation")
+}
+
+func TestRolloutPrewarm(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 59, 59, 500*int(time.Millisecond), time.UTC)
+	var mux sync.Mutex
+	clock := func() time.Time {
+		mux.Lock()
+		defer mux.Unlock()
+		return now
 	}
+	opened := make(chan string, 2)
+	r := New(Options{
+		Template:   "{{.Time}}.log",
+		TimeFormat: "15",
+		Rotation:   RotateHourly,
+		Clock:      clock,
+		Prewarm:    true,
+		BufferFunc2: func(c BufferConfig) (Buffer, error) {
+			opened <- c.Dest
+			return &MockBuffer{}, nil
+		},
+	})
+
+	r.Write([]byte("before"))
+	assert.Equal(t, "12.log", <-opened, "current destination should be opened")
+	assert.Equal(t, "13.log", <-opened, "next destination should be opened ahead")
+	assert.Eventually(t, func() bool {
+		r.mux.RLock()
+		defer r.mux.RUnlock()
+		return r.warm != nil
+	}, time.Second, time.Millisecond, "opened buffer should be kept")
+
+	mux.Lock()
+	now = now.Add(time.Second)
+	mux.Unlock()
+	r.Write([]byte("after"))
+	assert.Equal(t, "13.log", r.CurrentFile(), "boundary write should rotate")
+	assert.Empty(t, opened, "boundary write should reuse buffer opened ahead")
+	assert.NoError(t, r.Close())
 }
 
-func TestRolloutDestination(t *testing.T) {
-	cases := []struct {
-		root     string
-		template string
-		format   string
-		time     time.Time
-		expect   string
-	}{
-		{"", "test-{{.Time}}.log", "2006-01-02", time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), "test-1970-01-01.log"},
-		{"/var/log", "{{.Time}}.log", "2006-01-02", time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), "/var/log/1970-01-01.log"},
-		{"/var/log", "test-{{.Time}}.log", "2006-01-02", time.Date(2017, time.November, 11, 14, 15, 0, 0, time.UTC), "/var/log/test-2017-11-11.log"},
-		{"", "test-{{.Time}}.log", "2006-01-02 15:04", time.Date(2017, time.November, 11, 14, 15, 0, 0, time.UTC), "test-2017-11-11 14:15.log"},
-		{"", "test-{{.Time}}.log", "2006-01-02", time.Date(2017, time.November, 22, 0, 0, 0, 0, time.Local), "test-2017-11-22.log"},
+func TestRolloutPrewarmReconfigure(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 59, 59, 500*int(time.Millisecond), time.UTC)
+	release := make(chan struct{})
+	var opening sync.Once
+	started := make(chan struct{})
+	r := New(Options{
+		Root:       filepath.Join(root, "old"),
+		Template:   "{{.Time}}.log",
+		TimeFormat: "15",
+		Rotation:   RotateHourly,
+		Clock:      func() time.Time { return now },
+		Prewarm:    true,
+		BufferFunc2: func(c BufferConfig) (Buffer, error) {
+			if filepath.Base(c.Dest) == "13.log" {
+				opening.Do(func() { close(started) })
+				<-release
+			}
+			return NewFileBuffer(c.Dest, c.Size, c.Interval)
+		},
+	})
+
+	r.Write([]byte("before"))
+	<-started
+	waited := make(chan struct{})
+	go func() {
+		r.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait should not wait for destinations opened ahead")
 	}
 
-	for _, c := range cases {
-		r := New(Options{
-			Template:   c.template,
-			TimeFormat: c.format,
-			Root:       c.root,
-		})
-		actual := r.destination(c.time)
-		assert.Equal(t, c.expect, actual, "destination should match")
+	assert.NoError(t, r.Reconfigure(Options{
+		Root:       filepath.Join(root, "new"),
+		Template:   "{{.Time}}.log",
+		TimeFormat: "15",
+		Rotation:   RotateHourly,
+	}))
+	close(release)
+	assert.NoError(t, r.Close())
+
+	r.mux.RLock()
+	assert.Nil(t, r.warm, "buffer opened ahead for the old configuration should be discarded")
+	r.mux.RUnlock()
+	_, err := os.Stat(filepath.Join(root, "old", "13.log"))
+	assert.True(t, os.IsNotExist(err), "destination opened ahead for the old configuration should be removed")
+}
+
+func TestRolloutClosing(t *testing.T) {
+	r := New(Options{BufferFunc: NewMockBuffer})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-r.Closing():
+				return
+			default:
+			}
+			r.Write([]byte("any"))
+		}
+	}()
+
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, r.Close())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("producer should stop on closing")
+	}
+	select {
+	case <-r.Closing():
+	default:
+		t.Fatal("closing channel should be closed")
 	}
+
+	var b bytes.Buffer
+	r = New(Options{BufferFunc: NewWriterBuffer(&b), CloseGrace: time.Second})
+	final := make(chan error)
+	go func() {
+		<-r.Closing()
+		_, err := r.Write([]byte("final"))
+		final <- err
+	}()
+	closed := make(chan error)
+	go func() { closed <- r.Close() }()
+	assert.NoError(t, <-final, "final write after closing is signaled should succeed")
+	assert.NoError(t, <-closed)
+	assert.Equal(t, "final", b.String(), "final write should reach the destination")
+
+	r = New(Options{BufferFunc: NewMockBuffer, CloseGrace: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.CloseContext(ctx) // returns without waiting the grace, possibly with ctx.Err()
+	_, err := r.Write([]byte("late"))
+	assert.Equal(t, ErrClosed, err, "writes after the grace should fail")
+}
+
+// slowBuffer blocks writes until release is closed.
+type slowBuffer struct {
+	bytes.Buffer
+	release chan struct{}
+}
+
+func (b *slowBuffer) Write(p []byte) (int, error) {
+	<-b.release
+	return b.Buffer.Write(p)
+}
+
+func (b *slowBuffer) Flush() error { return nil }
+func (b *slowBuffer) Close() error { return nil }
+
+func TestRolloutWriteTimeout(t *testing.T) {
+	buf := &slowBuffer{release: make(chan struct{})}
+	r := New(Options{
+		WriteTimeout: 10 * time.Millisecond,
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return buf, nil
+		},
+	})
+
+	p := []byte("slow\n")
+	n, err := r.Write(p)
+	assert.Equal(t, ErrWriteTimeout, err, "blocked write should time out")
+	assert.Zero(t, n)
+	copy(p, "xxxx\n")
+
+	_, err = r.Write([]byte("next\n"))
+	assert.Equal(t, ErrWriteTimeout, err, "write should fail while previous one is in flight")
+	assert.Equal(t, ErrWriteTimeout, r.Flush(), "flush should wait for the write in flight")
+	assert.Equal(t, ErrWriteTimeout, r.Sync(), "sync should wait for the write in flight")
+
+	close(buf.release)
+	assert.NoError(t, r.Flush(), "flush should succeed once the write completes")
+	_, err = r.Write([]byte("fast\n"))
+	assert.NoError(t, err, "write should succeed once previous one completes")
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "slow\nfast\n", buf.String(), "timed out write should land with its own data")
+	assert.Equal(t, int64(2), r.Stats().WriteErrors)
+}
+
+func TestRolloutFlushOnIdle(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "test.log")
+	r := New(Options{
+		Root:        root,
+		Template:    "test.log",
+		Flush:       3600,
+		FlushOnIdle: 20 * time.Millisecond,
+	})
+
+	r.Write([]byte("1\n"))
+	r.Write([]byte("2\n"))
+	content, _ := os.ReadFile(name)
+	assert.Empty(t, content, "data should be buffered while writing")
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(name)
+		return string(content) == "1\n2\n"
+	}, time.Second, 5*time.Millisecond, "data should be flushed when idle")
+	assert.NoError(t, r.Close())
+}
+
+func TestRolloutAutoFlush(t *testing.T) {
+	ticker := &fakeTicker{c: make(chan time.Time)}
+	buf := &MockBuffer{}
+	r := New(Options{
+		AutoFlush: true,
+		Flush:     3,
+		Ticker: func(d time.Duration) Ticker {
+			ticker.interval = d
+			return ticker
+		},
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return buf, nil
+		},
+	})
+	r.Write([]byte("any"))
+
+	// The second tick is received only after the first flush is done.
+	ticker.c <- time.Now()
+	ticker.c <- time.Now()
+	assert.Equal(t, 3*time.Second, ticker.interval, "ticker should tick at flush interval")
+	assert.GreaterOrEqual(t, r.Stats().Flushes, int64(1), "buffer should be flushed on tick")
+
+	r.Close()
+	select {
+	case ticker.c <- time.Now():
+		t.Fatal("auto flushing should stop on close")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRolloutErrors(t *testing.T) {
+	r := New(Options{
+		Root:     t.TempDir(),
+		Template: "test.log",
+		Flush:    1,
+	})
+	defer r.Close()
+
+	r.Write([]byte("any"))
+	r.buf.Buffer.(*FileBuffer).f.Close()
+
+	select {
+	case err := <-r.Errors():
+		var perr *os.PathError
+		assert.True(t, errors.As(err, &perr), "flush error should be received")
+		assert.Equal(t, "flush", perr.Op)
+	case <-time.After(3 * time.Second):
+		t.Fatal("interval flushing error should be sent")
+	}
+
+	for i := 0; i < errorsSize+1; i++ {
+		r.report(errors.New("test"))
+	}
+	assert.Len(t, r.Errors(), errorsSize, "errors should be dropped when the channel is full")
+}
+
+func TestRolloutBuffered(t *testing.T) {
+	var marks []int
+	r := New(Options{
+		BufferSize:    10,
+		BufferFunc:    NewWriterBuffer(io.Discard),
+		HighWaterMark: 6,
+		OnHighWaterMark: func(buffered int) {
+			marks = append(marks, buffered)
+		},
+	})
+	assert.Zero(t, r.Buffered(), "nothing should be buffered before any write")
+	assert.Zero(t, r.Available(), "nothing should be available before any write")
+
+	r.Write([]byte("1234"))
+	assert.Equal(t, 4, r.Buffered())
+	assert.Equal(t, 6, r.Available())
+	r.Write([]byte("567"))
+	assert.Equal(t, []int{7}, marks, "high water mark should be reported")
+
+	r.Flush()
+	assert.Zero(t, r.Buffered(), "flushed buffer should be empty")
+	r.Close()
+}
+
+func TestRolloutWriteR(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.UTC)
+	r := New(Options{
+		BufferFunc: NewMockBuffer,
+		Clock:      func() time.Time { return now },
+	})
+
+	_, rotated, err := r.WriteR([]byte("first"))
+	assert.NoError(t, err)
+	assert.True(t, rotated, "first write should open a destination")
+	n, rotated, _ := r.WriteR([]byte("same"))
+	assert.Equal(t, 4, n)
+	assert.False(t, rotated, "write in the same period should not rotate")
+
+	now = now.Add(24 * time.Hour)
+	_, rotated, _ = r.WriteR([]byte("next"))
+	assert.True(t, rotated, "write in the next period should rotate")
+
+	r.Close()
+	_, rotated, err = r.WriteR([]byte("closed"))
+	assert.Equal(t, ErrClosed, err)
+	assert.False(t, rotated)
+}
+
+func TestRolloutReadFrom(t *testing.T) {
+	buf := new(bytes.Buffer)
+	var writes []string
+	r := New(Options{
+		BufferFunc: MultiBuffer(NewWriterBuffer(buf), func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return &recordingBuffer{writes: &writes}, nil
+		}),
+	})
+
+	line := strings.Repeat("x", 99) + "\n"
+	src := strings.Repeat(line, 1000) + "tail"
+	n, err := io.Copy(r, iotest.OneByteReader(strings.NewReader(src[:200])))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), n)
+
+	n, err = r.ReadFrom(strings.NewReader(src[200:]))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(src)-200), n, "all data should be written")
+	r.Close()
+	assert.Equal(t, src, buf.String(), "data should be written in order")
+
+	for _, w := range writes[:len(writes)-1] {
+		assert.True(t, strings.HasSuffix(w, "\n"), "chunks should end at line boundaries")
+	}
+	assert.Less(t, len(writes), 10, "data should be written in large chunks")
+
+	r = New(Options{BufferFunc: NewMockBuffer})
+	r.Close()
+	_, err = r.ReadFrom(strings.NewReader("closed\n"))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestRolloutReadFromWrites(t *testing.T) {
+	count := func(feed func(r *Rollout, src io.Reader)) int {
+		var writes []string
+		r := New(Options{BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return &recordingBuffer{writes: &writes}, nil
+		}})
+		feed(r, iotest.OneByteReader(strings.NewReader(strings.Repeat("some line\n", 100))))
+		r.Close()
+		return len(writes)
+	}
+
+	// Hiding ReadFrom, io.Copy writes every read.
+	copied := count(func(r *Rollout, src io.Reader) { io.Copy(struct{ io.Writer }{r}, src) })
+	read := count(func(r *Rollout, src io.Reader) { r.ReadFrom(src) })
+	assert.Equal(t, 1000, copied)
+	assert.Equal(t, 100, read, "ReadFrom should write once per line of a source returning single bytes")
+}
+
+// recordingBuffer records every write.
+type recordingBuffer struct {
+	writes *[]string
+}
+
+func (b *recordingBuffer) Write(p []byte) (int, error) {
+	*b.writes = append(*b.writes, string(p))
+	return len(p), nil
+}
+
+func (b *recordingBuffer) Flush() error { return nil }
+func (b *recordingBuffer) Close() error { return nil }
+
+func TestRolloutCurrentFileAfterClose(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{Root: root, Template: "test.log"})
+	r.Write([]byte("123"))
+	assert.NoError(t, r.Close())
+	assert.Equal(t, filepath.Join(root, "test.log"), r.CurrentFile(), "closed destination should still be reported")
+}
+
+// objectBuffer is a custom buffer appending to objects, telling their size and key.
+type objectBuffer struct {
+	recordingBuffer
+	key  string
+	size int64
+}
+
+func (b *objectBuffer) Write(p []byte) (int, error) {
+	b.size += int64(len(p))
+	return b.recordingBuffer.Write(p)
+}
+
+func (b *objectBuffer) Size() int64  { return b.size }
+func (b *objectBuffer) Name() string { return b.key }
+
+func TestRolloutSizerNamed(t *testing.T) {
+	var writes []string
+	r := New(Options{
+		Template: "test-{{.Seq}}.log",
+		MaxSize:  10,
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			// Every object already holds 8 bytes.
+			return &objectBuffer{recordingBuffer: recordingBuffer{writes: &writes}, key: "bucket/" + dest, size: 8}, nil
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("123"))
+	assert.Equal(t, "bucket/test-0.log", r.CurrentFile(), "name of the buffer should be reported")
+	_, rotated, err := r.WriteR([]byte("123"))
+	assert.NoError(t, err)
+	assert.True(t, rotated, "size of the destination should count toward MaxSize")
+	assert.Equal(t, "bucket/test-1.log", r.CurrentFile())
+}
+
+func TestRolloutSafeWriter(t *testing.T) {
+	r := New(Options{BufferFunc: NewMockBuffer})
+	w := r.SafeWriter()
+
+	n, err := w.Write([]byte("1234"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n, "written bytes should match")
+
+	r.Close()
+	n, err = w.Write([]byte("123"))
+	assert.NoError(t, err, "error should be discarded")
+	assert.Equal(t, 3, n, "data should be reported written")
+	assert.Equal(t, Stats{BytesWritten: 4, Dropped: 1}, r.Stats(), "dropped write should be counted")
+}
+
+func TestRolloutRotationEvents(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := New(Options{
+		Clock:      func() time.Time { return now },
+		BufferFunc: NewMockBuffer,
+		Rotation:   RotateSecondly,
+		Template:   "{{.Unix}}.log",
+	})
+	events := r.RotationEvents()
+	assert.Equal(t, events, r.RotationEvents(), "channel should be the same")
+
+	r.Write([]byte("1"))
+	assert.Len(t, events, 0, "opening the first destination is not a rotation")
+
+	now = now.Add(time.Second)
+	r.Write([]byte("2"))
+	assert.Equal(t, RotationEvent{Old: "1577836800.log", New: "1577836801.log", Time: now}, <-events)
+
+	for i := 0; i < rotationEventsSize+1; i++ {
+		now = now.Add(time.Second)
+		r.Write([]byte("3"))
+	}
+	assert.Len(t, events, rotationEventsSize, "events should be dropped when the channel is full")
+
+	r.Close()
+	for range events {
+	}
+	_, ok := <-events
+	assert.False(t, ok, "channel should be closed")
+}
+
+func TestRolloutClose(t *testing.T) {
+	r := New(Options{
+		BufferFunc: NewMockBuffer,
+	})
+	assert.Nil(t, r.buf, "buf should be nil if there is no write")
+	r.Close()
+
+	r = New(Options{
+		BufferFunc: NewMockBuffer,
+	})
+	r.Write([]byte("any"))
+	mb := r.buf.Buffer.(*MockBuffer)
+	r.Close()
+	r.Close()
+	mb.AssertNumberOfCalls(t, "Close", 1)
+
+	assert.True(t, r.closed, "closed flag should be true")
+
+	_, err := r.Write([]byte("test data"))
+	assert.Equal(t, ErrClosed, err, "write to closed writer should return error")
+	assert.Equal(t, ErrClosed, r.Flush(), "flush closed writer should return error")
+	mb.AssertNotCalled(t, "Flush")
+}
+
+func TestRolloutReopen(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "test.log",
+	})
+
+	name := filepath.Join(root, "test.log")
+	r.Write([]byte("before"))
+	assert.NoError(t, os.Rename(name, name+".1"))
+	assert.NoError(t, r.Reopen())
+	r.Write([]byte("after"))
+	r.Close()
+
+	content, _ := os.ReadFile(name + ".1")
+	assert.Equal(t, "before", string(content), "data before reopen should be in the moved file")
+	content, _ = os.ReadFile(name)
+	assert.Equal(t, "after", string(content), "data after reopen should be in a new file")
+
+	assert.Equal(t, ErrClosed, r.Reopen(), "reopen closed writer should return error")
+}
+
+func TestRolloutReconfigure(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "early.log",
+	})
+	defer r.Close()
+
+	r.Write([]byte("early"))
+	err := r.Reconfigure(Options{
+		Root:       filepath.Join(root, "final"),
+		Template:   "test-{{.Time}}.log",
+		TimeFormat: "2006",
+	})
+	assert.NoError(t, err)
+	r.Write([]byte("final"))
+
+	content, _ := os.ReadFile(filepath.Join(root, "early.log"))
+	assert.Equal(t, "early", string(content), "old buffer should be closed")
+	assert.Equal(t, filepath.Join(root, "final", time.Now().Format("test-2006.log")), r.CurrentFile(), "new destination should be used")
+
+	err = r.Reconfigure(Options{Template: "test-{{.Time}.log"})
+	assert.Error(t, err, "invalid template should be rejected")
+	assert.Equal(t, "2006", r.timeFormat, "nothing should change on error")
+}
+
+func TestRolloutReconfigureCustomBuffer(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "x.log",
+		Compress: true,
+	})
+
+	r.Write([]byte("file"))
+	assert.NoError(t, r.Reconfigure(Options{Root: root, Template: "y.log", BufferFunc: NewDiscardBuffer}))
+	r.Write([]byte("discarded"))
+	assert.NoError(t, r.RotateNow())
+	assert.NoError(t, r.Close(), "destinations of custom buffers should not be compressed")
+
+	_, err := os.Stat(filepath.Join(root, "x.log.gz"))
+	assert.NoError(t, err, "destination of the file buffer should still be compressed")
+	_, err = os.Stat(filepath.Join(root, "y.log"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRolloutReconfigureFileBuffer(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "x.log",
+		FileMode: 0600,
+		Compress: true,
+		Symlink:  "current.log",
+	})
+
+	r.Write([]byte("file"))
+	assert.NoError(t, r.Reconfigure(Options{Root: root, Template: "y.log", BufferFunc: NewDiscardBuffer}))
+	r.Write([]byte("discarded"))
+	assert.NoError(t, r.Reconfigure(Options{Root: root, Template: "z.log"}))
+	r.Write([]byte("file again"))
+
+	info, err := os.Stat(filepath.Join(root, "z.log"))
+	if assert.NoError(t, err, "nil BufferFunc should switch back to the file buffer") {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "FileMode should be kept")
+	}
+	link, _ := os.Readlink(filepath.Join(root, "current.log"))
+	assert.Equal(t, "z.log", link, "Symlink should be kept")
+
+	assert.NoError(t, r.Close())
+	_, err = os.Stat(filepath.Join(root, "z.log.gz"))
+	assert.NoError(t, err, "Compress should be kept")
+	_, err = os.Stat(filepath.Join(root, "y.log"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRolloutCurrentFile(t *testing.T) {
+	r := New(Options{
+		BufferFunc: NewMockBuffer,
+		Root:       "/var/log",
+		Template:   "test-{{.Time}}.log",
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 11, 14, 15, 0, 0, time.Local)
+		},
+	})
+	assert.Equal(t, "", r.CurrentFile(), "current file should be empty before any write")
+
+	r.Write([]byte("any"))
+	assert.Equal(t, "/var/log/test-2017-11-11.log", r.CurrentFile(), "current file should match destination")
+}
+
+func TestRolloutFileMode(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:     root,
+		Template: "test.log",
+		FileMode: 0600,
+	})
+	defer r.Close()
+
+	r.Write([]byte("any"))
+	info, err := os.Stat(filepath.Join(root, "test.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "file mode should match")
+}
+
+func TestRolloutCreateDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "logs")
+	r := New(Options{
+		Root:     root,
+		Template: "{{.Time}}/test.log",
+		DirMode:  0700,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("any"))
+	assert.NoError(t, err, "missing directories should be created")
+
+	info, err := os.Stat(filepath.Join(root, "2017-11-05"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "directory mode should match")
+}
+
+func TestRolloutSymlink(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Symlink:  "current.log",
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	defer r.Close()
+
+	link := filepath.Join(root, "current.log")
+
+	r.Write([]byte("day 5\n"))
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-2017-11-05.log", target, "symlink should point at current file")
+
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+	target, err = os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "test-2017-11-06.log", target, "symlink should follow rotation")
+}
+
+type blockingBuffer struct {
+	MockBuffer
+	release chan struct{}
+}
+
+func (b *blockingBuffer) Close() error {
+	<-b.release
+	return nil
+}
+
+func TestRolloutCloseContext(t *testing.T) {
+	b := &blockingBuffer{release: make(chan struct{})}
+	defer close(b.release)
+
+	r := New(Options{
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			return b, nil
+		},
+	})
+	r.Write([]byte("any"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := r.CloseContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "close should give up when context is done")
+
+	_, err = r.Write([]byte("any"))
+	assert.Equal(t, ErrClosed, err, "writer should be closed anyway")
+	assert.NoError(t, r.CloseContext(ctx), "closing again should be a no-op")
+}
+
+func TestRolloutPosition(t *testing.T) {
+	cases := []struct {
+		time     time.Time
+		interval int
+		position int64
+	}{
+		{time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), 1, 0},
+		{time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), RotateMinutely, 0},
+		{time.Date(2017, time.November, 11, 14, 9, 27, 0, time.UTC), RotateMinutely, 25173489},
+		{time.Date(2017, time.November, 11, 14, 9, 27, 0, time.UTC), RotateDaily, 17481},
+		{time.Date(2017, time.November, 22, 0, 0, 0, 0, time.UTC), RotateDaily, 17492},
+		{time.Date(2017, time.November, 22, 0, 0, 0, 0, time.Local), RotateDaily, 17492},
+		{time.Date(1969, time.December, 31, 23, 59, 59, 0, time.UTC), RotateMinutely, -1},
+		{time.Date(1969, time.December, 31, 23, 59, 0, 0, time.UTC), RotateMinutely, -1},
+		{time.Date(1969, time.December, 31, 23, 58, 59, 0, time.UTC), RotateMinutely, -2},
+		{time.Date(1969, time.December, 31, 0, 0, 0, 0, time.UTC), RotateDaily, -1},
+		{time.Date(1969, time.December, 31, 12, 0, 0, 0, time.UTC), RotateDaily, -1},
+		{time.Date(2040, time.January, 1, 0, 0, 1, 0, time.UTC), 1, 2208988801},
+		{time.Date(2040, time.January, 1, 0, 0, 0, 0, time.UTC), RotateDaily, 25567},
+	}
+
+	for _, c := range cases {
+		r := New(Options{
+			Rotation: c.interval,
+		})
+
+		actual := r.position(c.time)
+		assert.Equal(t, c.position, actual, "position should match")
+	}
+
+	r := New(Options{Rotation: RotateDaily, Location: time.UTC})
+	start := time.Date(1969, time.December, 31, 0, 0, 0, 0, time.UTC)
+	assert.True(t, start.Equal(r.periodStart(start.Add(12*time.Hour))), "pre-epoch period should start at midnight")
+}
+
+func TestRolloutUTC(t *testing.T) {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	assert.NoError(t, err)
+	clock := func() time.Time { return time.Now().In(loc) }
+
+	local := New(Options{Template: "test-{{.Time}}.log", Clock: clock, Location: loc})
+	utc := New(Options{Template: "test-{{.Time}}.log", Clock: clock, Location: loc, UTC: true})
+
+	// 2017-11-05 02:00 in Shanghai is 2017-11-04 18:00 UTC.
+	early := time.Date(2017, time.November, 5, 2, 0, 0, 0, loc)
+	late := time.Date(2017, time.November, 5, 10, 0, 0, 0, loc)
+
+	assert.Equal(t, local.position(early), local.position(late), "local days should start at local midnight")
+	assert.Equal(t, utc.position(early)+1, utc.position(late), "utc days should start at utc midnight")
+
+	dest, _ := local.destination(early)
+	assert.Equal(t, "test-2017-11-05.log", dest, "local time should be formatted")
+	dest, _ = utc.destination(early)
+	assert.Equal(t, "test-2017-11-04.log", dest, "utc time should be formatted")
+	assert.Equal(t, time.Date(2017, time.November, 4, 0, 0, 0, 0, time.UTC), utc.periodStart(early).UTC(), "period should start at utc midnight")
+}
+
+func TestRolloutLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	assert.NoError(t, err)
+
+	r := New(Options{
+		Template: "test-{{.Time}}.log",
+		Location: loc,
+		Clock: func() time.Time {
+			return time.Now().UTC()
+		},
+	})
+
+	// Clocks move forward at 2017-03-12 02:00 in New York.
+	cases := []struct {
+		time     time.Time
+		position int64
+		dest     string
+	}{
+		{time.Date(2017, time.March, 11, 23, 30, 0, 0, loc), 17236, "test-2017-03-11.log"},
+		{time.Date(2017, time.March, 12, 0, 30, 0, 0, loc), 17237, "test-2017-03-12.log"},
+		{time.Date(2017, time.March, 12, 3, 30, 0, 0, loc), 17237, "test-2017-03-12.log"},
+		{time.Date(2017, time.March, 12, 23, 30, 0, 0, loc), 17237, "test-2017-03-12.log"},
+		{time.Date(2017, time.March, 13, 0, 10, 0, 0, loc), 17238, "test-2017-03-13.log"},
+	}
+
+	for _, c := range cases {
+		utc := c.time.UTC()
+		assert.Equal(t, c.position, r.position(utc), "position of %s should match", c.time)
+		dest, _ := r.destination(utc)
+		assert.Equal(t, c.dest, dest, "destination of %s should be in location", c.time)
+	}
+
+	start := r.periodStart(time.Date(2017, time.March, 12, 23, 30, 0, 0, loc))
+	assert.True(t, start.Equal(time.Date(2017, time.March, 12, 0, 0, 0, 0, loc)), "period should start at local midnight")
+}
+
+func TestRolloutDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+
+	local := time.Local
+	time.Local = loc
+	defer func() {
+		time.Local = local
+	}()
+
+	// Rollout is created in winter, clocks move forward at 2017-03-26 02:00 in Berlin.
+	now := time.Date(2017, time.January, 10, 12, 0, 0, 0, time.Local)
+	r := New(Options{
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	cases := []struct {
+		time     time.Time
+		position int64
+	}{
+		{time.Date(2017, time.March, 25, 23, 59, 0, 0, time.Local), 17250},
+		{time.Date(2017, time.March, 26, 0, 0, 0, 0, time.Local), 17251},
+		{time.Date(2017, time.March, 26, 23, 59, 0, 0, time.Local), 17251},
+		{time.Date(2017, time.March, 27, 0, 0, 0, 0, time.Local), 17252},
+		{time.Date(2017, time.July, 1, 0, 30, 0, 0, time.Local), 17348},
+		{time.Date(2017, time.June, 30, 23, 30, 0, 0, time.Local), 17347},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.position, r.position(c.time), "summer days should still roll at local midnight: %s", c.time)
+	}
+}
+
+func TestRolloutDestination(t *testing.T) {
+	cases := []struct {
+		root     string
+		template string
+		format   string
+		time     time.Time
+		expect   string
+	}{
+		{"", "test-{{.Time}}.log", "2006-01-02", time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), "test-1970-01-01.log"},
+		{"/var/log", "{{.Time}}.log", "2006-01-02", time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC), "/var/log/1970-01-01.log"},
+		{"/var/log", "test-{{.Time}}.log", "2006-01-02", time.Date(2017, time.November, 11, 14, 15, 0, 0, time.UTC), "/var/log/test-2017-11-11.log"},
+		{"", "test-{{.Time}}.log", "2006-01-02 15:04", time.Date(2017, time.November, 11, 14, 15, 0, 0, time.UTC), "test-2017-11-11 14:15.log"},
+		{"", "test-{{.Time}}.log", "2006-01-02", time.Date(2017, time.November, 22, 0, 0, 0, 0, time.Local), "test-2017-11-22.log"},
+	}
+
+	for _, c := range cases {
+		r := New(Options{
+			Template:   c.template,
+			TimeFormat: c.format,
+			Root:       c.root,
+		})
+		actual, err := r.destination(c.time)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expect, actual, "destination should match")
+	}
+}
+
+func TestRolloutDestinationUnix(t *testing.T) {
+	r := New(Options{
+		Template: "test-{{.Time}}-{{.Unix}}-{{.Nano}}.log",
+		Rotation: RotateMinutely,
+	})
+
+	start := time.Date(2017, time.November, 11, 14, 15, 0, 0, time.UTC)
+	expect := "test-2017-11-11-1510409700-1510409700000000000.log"
+	for _, d := range []time.Duration{0, 10 * time.Second, 59 * time.Second} {
+		actual, err := r.destination(start.Add(d))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, actual, "unix and nano should be the start of period")
+	}
+
+	next, _ := r.destination(start.Add(time.Minute))
+	assert.NotEqual(t, expect, next, "next period should not collide")
+}
+
+func TestRolloutTemplateError(t *testing.T) {
+	r := New(Options{
+		BufferFunc: NewMockBuffer,
+		Template:   "test-{{.Foo}}.log",
+	})
+
+	n, err := r.Write([]byte("any"))
+	var terr *TemplateError
+	assert.True(t, errors.As(err, &terr), "write should return template error")
+	assert.Zero(t, n, "write byte should be zero")
+	assert.Nil(t, r.buf, "no buffer should be opened")
+}
+
+func TestRolloutRotate(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"test-2017-11-01.log", "test-2017-11-02.log", "test-2017-11-03.log", "test-2017-11-04.log", "other.log"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte("old\n"), 0644))
+	}
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Keeps:    3,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("new\n"))
+	assert.NoError(t, err)
+
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{"test-2017-11-03.log", "test-2017-11-04.log", "test-2017-11-05.log", "other.log"}, names, "only the most recent files should be kept")
+
+	r.keeps = 1
+	assert.NoError(t, r.Rotate())
+	_, err = os.Stat(filepath.Join(root, "test-2017-11-05.log"))
+	assert.NoError(t, err, "current file should never be removed")
+	_, err = os.Stat(filepath.Join(root, "test-2017-11-04.log"))
+	assert.True(t, os.IsNotExist(err), "older file should be removed")
+}
+
+func TestRolloutRotateUnrelatedFiles(t *testing.T) {
+	root := t.TempDir()
+	unrelated := []string{"auth.log", "kern.log", "app.log", "rollout-notes.log", "2017-13-45.log"}
+	for _, name := range append([]string{"2017-11-01.log", "2017-11-02.log", "2017-11-03.log"}, unrelated...) {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte("old\n"), 0644))
+	}
+
+	r := New(Options{
+		Root:          root,
+		Template:      "{{.Time}}.log",
+		Keeps:         1,
+		MaxTotalBytes: 1,
+		MaxAge:        time.Hour,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("new\n"))
+	assert.NoError(t, err)
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, append([]string{"2017-11-05.log"}, unrelated...), names,
+		"files not matching the time format should survive every limit")
+
+	assert.Equal(t, "[0-9]{4}-[0-9]{2}-[0-9]{2}", layoutExpr("2006-01-02"))
+	assert.Equal(t, "[A-Za-z]{3} [0-9]{1,2}, [0-9]{4}T[0-9]{2}[AP]M[.,][0-9]{3}", layoutExpr("Jan 2, 2006T03PM.000"))
+}
+
+func TestRolloutRotateParsedTime(t *testing.T) {
+	root := t.TempDir()
+	// Lexically, Dec sorts before Nov and "Nov 9" after "Nov 30".
+	for _, name := range []string{"test-Nov 9, 2017.log", "test-Nov 30, 2017.log", "test-Dec 1, 2017.log"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte("old\n"), 0644))
+	}
+
+	r := New(Options{
+		Root:       root,
+		Template:   "test-{{.Time}}.log",
+		TimeFormat: "Jan 2, 2006",
+		Keeps:      3,
+		Clock: func() time.Time {
+			return time.Date(2017, time.December, 2, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("new\n"))
+	assert.NoError(t, err)
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{"test-Nov 30, 2017.log", "test-Dec 1, 2017.log", "test-Dec 2, 2017.log"}, names,
+		"files should be ordered by the parsed time")
+
+	// Names which don't parse are left alone, whatever their modification time.
+	old := filepath.Join(root, "test-someday.log")
+	assert.NoError(t, os.WriteFile(old, []byte("old\n"), 0644))
+	assert.NoError(t, os.Chtimes(old, time.Now(), time.Date(2017, time.November, 1, 0, 0, 0, 0, time.Local)))
+	r.SetKeeps(1)
+	r.SetMaxTotalBytes(1)
+	assert.NoError(t, r.Rotate())
+	_, err = os.Stat(old)
+	assert.NoError(t, err, "file whose time can't be parsed should be kept")
+	_, err = os.Stat(filepath.Join(root, "test-Nov 30, 2017.log"))
+	assert.True(t, os.IsNotExist(err), "parsed files should still be removed")
+}
+
+func TestRolloutRotateEarlierPids(t *testing.T) {
+	root := t.TempDir()
+	for pid := 100; pid < 105; pid++ {
+		name := fmt.Sprintf("rollout-2017-11-0%d-%d.log", pid-99, pid)
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte("old\n"), 0644))
+	}
+
+	r := New(Options{
+		Root:        root,
+		SafeDefault: true,
+		Pid:         200,
+		Keeps:       2,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 6, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	_, err := r.Write([]byte("new\n"))
+	assert.NoError(t, err)
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{"rollout-2017-11-05-104.log", "rollout-2017-11-06-200.log"}, names,
+		"destinations of earlier pids should be removed")
+}
+
+func TestRolloutSetRetention(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 1, 12, 0, 0, 0, time.Local)
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Keeps:    5,
+		Clock:    func() time.Time { return now },
+	})
+	defer r.Close()
+
+	count := func() int {
+		names, _ := filepath.Glob(filepath.Join(root, "*.log"))
+		return len(names)
+	}
+	for i := 0; i < 4; i++ {
+		r.Write([]byte("data\n"))
+		now = now.Add(24 * time.Hour)
+	}
+	assert.Equal(t, 4, count(), "files within keeps should be retained")
+
+	r.SetKeeps(2)
+	r.Write([]byte("data\n"))
+	assert.Equal(t, 2, count(), "new keeps should be enforced on the next rotation")
+
+	r.SetKeeps(-1)
+	r.SetMaxTotalBytes(5)
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("data\n"))
+	assert.Equal(t, 2, count(), "new total size should be enforced")
+
+	r.SetMaxTotalBytes(0)
+	r.SetMaxAge(time.Hour)
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("data\n"))
+	assert.Equal(t, 1, count(), "new max age should be enforced")
+
+	r.SetKeeps(0)
+	assert.Equal(t, defaultKeeps, r.keeps, "0 should restore the default like the option")
+}
+
+func TestRolloutRotateCompressedSiblings(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"test-2017-11-01.log.gz",
+		"test-2017-11-02.log", "test-2017-11-02.log.gz",
+		"test-2017-11-03.log", "test-2017-11-03.log.gz",
+		"test-2017-11-04.log",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte("old\n"), 0644))
+	}
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Compress: true,
+		Keeps:    3,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	files, err := r.destinations()
+	assert.NoError(t, err)
+	if assert.Len(t, files, 4, "compressed copies should be grouped with originals") {
+		assert.Equal(t, filepath.Join(root, "test-2017-11-02.log"), files[1].path)
+		assert.Equal(t, int64(8), files[1].size, "sizes of siblings should add up")
+	}
+
+	r.Write([]byte("new\n"))
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{
+		"test-2017-11-03.log", "test-2017-11-03.log.gz",
+		"test-2017-11-04.log",
+		"test-2017-11-05.log",
+	}, names, "siblings should be kept or removed together")
+}
+
+func TestRolloutMaxTotalBytes(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{
+		"test-2017-11-01.log.gz": 40,
+		"test-2017-11-02.log.gz": 30,
+		"test-2017-11-03.log":    20,
+		"test-2017-11-04.log":    10,
+	}
+	for name, size := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), make([]byte, size), 0644))
+	}
+
+	r := New(Options{
+		Root:          root,
+		Template:      "test-{{.Time}}.log",
+		Compress:      true,
+		Keeps:         -1,
+		MaxTotalBytes: 65,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("any"))
+	r.Flush()
+	assert.NoError(t, r.Rotate())
+
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{"test-2017-11-02.log.gz", "test-2017-11-03.log", "test-2017-11-04.log", "test-2017-11-05.log"}, names, "oldest files should be removed until total fits")
+
+	r.maxTotalBytes = 1
+	assert.NoError(t, r.Rotate())
+	names, _ = filepath.Glob(filepath.Join(root, "*"))
+	assert.Equal(t, []string{filepath.Join(root, "test-2017-11-05.log")}, names, "current file should never be removed")
+}
+
+func TestRolloutMaxAge(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"app-2017-10-30-x.log", "app-2017-11-01-x.log", "app-2017-11-03-x.log", "app-bad-x.log", "other-2017-10-01.log"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), nil, 0644))
+	}
+
+	r := New(Options{
+		Root:     root,
+		Template: "app-{{.Time}}-x.log",
+		Keeps:    -1,
+		MaxAge:   3 * 24 * time.Hour,
+		Clock: func() time.Time {
+			return time.Date(2017, time.November, 4, 12, 0, 0, 0, time.Local)
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("any"))
+
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.ElementsMatch(t, []string{"app-2017-11-01-x.log", "app-2017-11-03-x.log", "app-2017-11-04-x.log", "app-bad-x.log", "other-2017-10-01.log"}, names, "only files older than max age should be removed")
+}
+
+func TestRolloutMaxAgePeriodEnd(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "app-2017-11-01.log"), nil, 0644))
+
+	// The file of Nov 1 holds data until Nov 2, 00:00.
+	now := time.Date(2017, time.November, 2, 23, 59, 0, 0, time.Local)
+	r := New(Options{
+		Root:     root,
+		Template: "app-{{.Time}}.log",
+		Keeps:    -1,
+		MaxAge:   24 * time.Hour,
+		Clock:    func() time.Time { return now },
+	})
+	defer r.Close()
+
+	r.Write([]byte("any"))
+	_, err := os.Stat(filepath.Join(root, "app-2017-11-01.log"))
+	assert.NoError(t, err, "file should be kept until max age after its period ends")
+
+	now = time.Date(2017, time.November, 3, 0, 0, 0, 0, time.Local)
+	r.Write([]byte("any"))
+	_, err = os.Stat(filepath.Join(root, "app-2017-11-01.log"))
+	assert.True(t, os.IsNotExist(err), "file should be removed once max age passed since its period ended")
+}
+
+func TestRolloutCompress(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Compress: true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("day 5\n"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+
+	name := filepath.Join(root, "test-2017-11-05.log")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(name)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond, "original file should be removed")
+
+	f, err := os.Open(name + ".gz")
+	assert.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	content, _ := io.ReadAll(zr)
+	assert.Equal(t, "day 5\n", string(content), "compressed content should match")
+
+	_, err = os.Stat(filepath.Join(root, "test-2017-11-06.log"))
+	assert.NoError(t, err, "current file should not be compressed")
+}
+
+func TestRolloutCompressOnClose(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "test.log")
+
+	for _, line := range []string{"run 1\n", "run 2\n"} {
+		r := New(Options{Root: root, Template: "test.log", Compress: true})
+		r.Write([]byte(line))
+		assert.NoError(t, r.Close())
+
+		_, err := os.Stat(name)
+		assert.True(t, os.IsNotExist(err), "last file should be compressed on close")
+	}
+
+	f, err := os.Open(name + ".gz")
+	assert.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	assert.NoError(t, err)
+	content, _ := io.ReadAll(zr)
+	assert.Equal(t, "run 1\nrun 2\n", string(content), "restarted run should be appended to the archive")
+}
+
+func TestRolloutCompressWait(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Compress: true,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	for i := 0; i < 5; i++ {
+		r.Write([]byte(strings.Repeat("data\n", 1000)))
+		now = now.Add(24 * time.Hour)
+	}
+	r.Write([]byte("last\n"))
+	r.Wait()
+	gz, _ := filepath.Glob(filepath.Join(root, "*.gz"))
+	assert.Len(t, gz, 5, "rotated out destinations should be compressed after Wait")
+	assert.NoError(t, r.Close())
+
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	for i := range names {
+		names[i] = filepath.Base(names[i])
+	}
+	assert.Equal(t, []string{
+		"test-2017-11-05.log.gz",
+		"test-2017-11-06.log.gz",
+		"test-2017-11-07.log.gz",
+		"test-2017-11-08.log.gz",
+		"test-2017-11-09.log.gz",
+		"test-2017-11-10.log.gz",
+	}, names, "all destinations should be compressed without temporary files left")
+}
+
+func TestRolloutPostRotate(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	var mux sync.Mutex
+	var paths []string
+	var errs []error
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.log",
+		Compress: true,
+		Clock: func() time.Time {
+			return now
+		},
+		PostRotate: func(oldPath string) error {
+			mux.Lock()
+			defer mux.Unlock()
+			_, err := os.Stat(oldPath)
+			assert.NoError(t, err, "compressed file should exist")
+			paths = append(paths, filepath.Base(oldPath))
+			return errors.New("post rotate")
+		},
+		OnError: func(err error) {
+			mux.Lock()
+			defer mux.Unlock()
+			errs = append(errs, err)
+		},
+	})
+	r.Write([]byte("day 5\n"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+	r.Wait()
+
+	mux.Lock()
+	assert.Equal(t, []string{"test-2017-11-05.log.gz"}, paths, "post rotate should be called after compression")
+	assert.Len(t, errs, 1, "post rotate error should be reported")
+	mux.Unlock()
+
+	assert.Error(t, r.Close(), "post rotate error of the last destination should be returned")
+	assert.Equal(t, []string{"test-2017-11-05.log.gz", "test-2017-11-06.log.gz"}, paths, "close should run post rotate")
+}
+
+func TestRolloutRenameFunc(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:           root,
+		Template:       "test-{{.Time}}.log",
+		Compress:       true,
+		CompressSuffix: ".gzip",
+		RenameFunc: func(original string) string {
+			return filepath.Join(filepath.Dir(original), "archive", filepath.Base(original))
+		},
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("day 5\n"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(root, "archive", "test-2017-11-05.log.gzip"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond, "rotated file should be moved and compressed")
+
+	_, err := os.Stat(filepath.Join(root, "test-2017-11-05.log"))
+	assert.True(t, os.IsNotExist(err), "original file should be moved")
+}
+
+// upperCompressor "compresses" data to upper case.
+type upperCompressor struct {
+	io.Writer
+}
+
+func (w upperCompressor) Write(p []byte) (int, error) {
+	return w.Writer.Write(bytes.ToUpper(p))
+}
+
+func (w upperCompressor) Close() error {
+	return nil
+}
+
+func TestRolloutCompressor(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:           root,
+		Template:       "test.log",
+		Compress:       true,
+		CompressSuffix: ".up",
+		Compressor: func(dst io.Writer) (io.WriteCloser, error) {
+			return upperCompressor{dst}, nil
+		},
+	})
+	r.Write([]byte("data\n"))
+	assert.NoError(t, r.Close())
+
+	content, err := os.ReadFile(filepath.Join(root, "test.log.up"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DATA\n", string(content), "custom compressor should be used")
+}
+
+func TestCompressFileFailure(t *testing.T) {
+	root := t.TempDir()
+	name := filepath.Join(root, "test.log")
+	assert.NoError(t, os.WriteFile(name, []byte("data"), 0644))
+
+	err := compressFile(name, defaultCompressSuffix, gzipCompressor(100))
+	assert.Error(t, err, "invalid level should fail")
+
+	names, _ := filepath.Glob(filepath.Join(root, "*"))
+	assert.Equal(t, []string{name}, names, "failed compression should leave no partial archive")
+}
+
+func TestRolloutMaxSize(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.{{.Seq}}.log",
+		MaxSize:  10,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	r.Write([]byte("123456"))
+	r.Write([]byte("1234"))
+	r.Write([]byte("12"))
+	r.Write([]byte("123456789012"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("1"))
+	r.Close()
+
+	cases := map[string]string{
+		"test-2017-11-05.0.log": "1234561234",
+		"test-2017-11-05.1.log": "12",
+		"test-2017-11-05.2.log": "123456789012",
+		"test-2017-11-06.0.log": "1",
+	}
+	for name, expect := range cases {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(content), "content of %s should match", name)
+	}
+
+	r = New(Options{Root: root, Template: "test-{{.Time}}.{{.Seq}}.log", Clock: func() time.Time { return now }})
+	files, err := r.destinations()
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f.path))
+	}
+	assert.Equal(t, []string{"test-2017-11-05.0.log", "test-2017-11-05.1.log", "test-2017-11-05.2.log", "test-2017-11-06.0.log"}, names, "destinations should be ordered by time and seq")
+}
+
+func TestRolloutHeader(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.{{.Seq}}.csv",
+		MaxSize:  10,
+		Header:   []byte("a,b\n"),
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	r.Write([]byte("1,2\n"))
+	r.Write([]byte("3,4\n"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("5,6\n"))
+	r.Close()
+
+	cases := map[string]string{
+		"test-2017-11-05.0.csv": "a,b\n1,2\n",
+		"test-2017-11-05.1.csv": "a,b\n3,4\n",
+		"test-2017-11-06.0.csv": "a,b\n5,6\n",
+	}
+	for name, expect := range cases {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(content), "content of %s should match", name)
+	}
+
+	r = New(Options{
+		Root:     root,
+		Template: "func.log",
+		HeaderFunc: func(dest string, t time.Time) []byte {
+			return []byte("# " + filepath.Base(dest) + "\n")
+		},
+		Header: []byte("ignored\n"),
+	})
+	r.Write([]byte("1\n"))
+	r.Close()
+	content, _ := os.ReadFile(filepath.Join(root, "func.log"))
+	assert.Equal(t, "# func.log\n1\n", string(content), "HeaderFunc should take precedence")
+}
+
+func TestRolloutHeaderFreshOnly(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "empty.log"), nil, 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "data.log"), []byte("old\n"), 0644))
+
+	for name, expect := range map[string]string{
+		"empty.log": "\xef\xbb\xbfnew\n",
+		"data.log":  "old\nnew\n",
+	} {
+		r := New(Options{Root: root, Template: name, Header: []byte("\xef\xbb\xbf")})
+		r.Write([]byte("new\n"))
+		r.Close()
+
+		content, _ := os.ReadFile(filepath.Join(root, name))
+		assert.Equal(t, expect, string(content), "header of %s should only be written at offset 0", name)
+	}
+}
+
+func TestRolloutHeaderRestart(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+	start := func() *Rollout {
+		return New(Options{
+			Root:     root,
+			Template: "test-{{.Time}}-{{.Seq}}.csv",
+			Header:   []byte("id,name\n"),
+			MaxSize:  16,
+			Clock:    func() time.Time { return now },
+		})
+	}
+
+	// A crash leaves buffered data unflushed, the written part is kept.
+	r := start()
+	r.Write([]byte("1,a\n"))
+	r.Flush()
+	r.Write([]byte("lost\n"))
+	r.buf.Buffer.(*FileBuffer).f.Close()
+
+	r = start()
+	r.Write([]byte("2,b\n"))
+	r.Close()
+	content, _ := os.ReadFile(filepath.Join(root, "test-2017-11-05-0.csv"))
+	assert.Equal(t, "id,name\n1,a\n2,b\n", string(content), "restart should append without header")
+
+	r = start()
+	r.Write([]byte("3,c\n"))
+	r.Close()
+	content, _ = os.ReadFile(filepath.Join(root, "test-2017-11-05-1.csv"))
+	assert.Equal(t, "id,name\n3,c\n", string(content), "restart after full destination should write header to the next one")
+}
+
+func TestRolloutFooter(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.json",
+		Header:   []byte("["),
+		Footer:   []byte("]"),
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	r.Write([]byte("1"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("2"))
+	r.Close()
+	r.Close()
+
+	cases := map[string]string{
+		"test-2017-11-05.json": "[1]",
+		"test-2017-11-06.json": "[2]",
+	}
+	for name, expect := range cases {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(content), "content of %s should match", name)
+	}
+}
+
+func TestRolloutTimeFormatDirectories(t *testing.T) {
+	// A slash separates directories everywhere, the OS separator may be used as well.
+	for _, sep := range []string{"/", string(filepath.Separator)} {
+		root := t.TempDir()
+		now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+		r := New(Options{
+			Root:       root,
+			Template:   "app/{{.Time}}.log",
+			TimeFormat: strings.Join([]string{"2006", "01", "02"}, sep),
+			Keeps:      2,
+			Clock: func() time.Time {
+				return now
+			},
+		})
+		for i := 0; i < 3; i++ {
+			r.Write([]byte("data\n"))
+			now = now.Add(24 * time.Hour)
+		}
+		r.Close()
+
+		_, err := os.Stat(filepath.Join(root, "app", "2017", "11", "05.log"))
+		assert.True(t, os.IsNotExist(err), "oldest destination should be removed with separator %q", sep)
+		for _, name := range []string{"06.log", "07.log"} {
+			_, err := os.Stat(filepath.Join(root, "app", "2017", "11", name))
+			assert.NoError(t, err, "%s should be created in nested directories with separator %q", name, sep)
+		}
+
+		files, err := r.destinations()
+		assert.NoError(t, err)
+		if assert.Len(t, files, 2) {
+			assert.Equal(t, time.Date(2017, time.November, 6, 0, 0, 0, 0, time.Local), files[0].at, "time should be parsed from nested path with separator %q", sep)
+		}
+	}
+}
+
+// failingBuffer fails to close.
+type failingBuffer struct {
+	bytes.Buffer
+	err error
+}
+
+func (b *failingBuffer) Flush() error { return nil }
+func (b *failingBuffer) Close() error { return b.err }
+
+func TestRolloutRotateCloseError(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.UTC)
+	failure := errors.New("no space left on device")
+	var bufs []*failingBuffer
+	var errs []error
+	r := New(Options{
+		Template: "test-{{.Time}}.log",
+		BufferFunc: func(dest string, size int, interval time.Duration) (Buffer, error) {
+			b := &failingBuffer{err: failure}
+			bufs = append(bufs, b)
+			return b, nil
+		},
+		OnError: func(err error) { errs = append(errs, err) },
+		Clock:   func() time.Time { return now },
+	})
+
+	r.Write([]byte("day 5\n"))
+	now = now.Add(24 * time.Hour)
+	_, err := r.Write([]byte("day 6\n"))
+	assert.NoError(t, err, "write should go on in the new destination")
+	assert.Equal(t, "day 6\n", bufs[1].String())
+
+	if assert.Len(t, errs, 1, "close error should be reported") {
+		var perr *os.PathError
+		assert.True(t, errors.As(errs[0], &perr))
+		assert.Equal(t, "close", perr.Op)
+		assert.Equal(t, "test-2017-11-05.log", perr.Path, "error should carry the old destination")
+		assert.True(t, errors.Is(errs[0], failure))
+	}
+}
+
+func TestRolloutRemoveEmpty(t *testing.T) {
+	root := t.TempDir()
+	r := New(Options{
+		Root:        root,
+		Template:    "test-{{.Seq}}.log",
+		RemoveEmpty: true,
+		Compress:    true,
+	})
+
+	r.Write([]byte("data\n"))
+	assert.NoError(t, r.RotateNow())
+	assert.NoError(t, r.RotateNow())
+	assert.NoError(t, r.Close())
+	r.Wait()
+
+	_, err := os.Stat(filepath.Join(root, "test-0.log.gz"))
+	assert.NoError(t, err, "written destination should be kept")
+	_, err = os.Stat(filepath.Join(root, "test-1.log"))
+	assert.True(t, os.IsNotExist(err), "empty destination should be removed when rotated out")
+	_, err = os.Stat(filepath.Join(root, "test-2.log"))
+	assert.True(t, os.IsNotExist(err), "empty destination should be removed on close")
+	_, err = os.Stat(filepath.Join(root, "test-2.log.gz"))
+	assert.True(t, os.IsNotExist(err), "removed destination should not be compressed")
+
+	r = New(Options{Root: root, Template: "other.log", RemoveEmpty: true})
+	r.RotateNow()
+	os.WriteFile(filepath.Join(root, "other.log"), []byte("appended elsewhere\n"), 0644)
+	assert.NoError(t, r.Close())
+	_, err = os.Stat(filepath.Join(root, "other.log"))
+	assert.NoError(t, err, "destination written by others should be kept")
+}
+
+func TestRolloutManualRotate(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.UTC)
+	r := New(Options{
+		Template:     "test-{{.Time}}.log",
+		BufferFunc:   NewMockBuffer,
+		ManualRotate: true,
+		MaxSize:      4,
+		Clock:        func() time.Time { return now },
+	})
+	events := r.RotationEvents()
+
+	r.Write([]byte("day5"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day6"))
+	r.Write([]byte("day6"))
+	assert.Equal(t, "test-2017-11-05.log", r.CurrentFile(), "destination should be kept until rotated")
+	assert.Equal(t, RotationEvent{Old: "test-2017-11-05.log", New: "test-2017-11-06.log", Time: now, Pending: true}, <-events,
+		"due rotation should be reported")
+	assert.Empty(t, events, "due rotation should be reported once")
+
+	assert.NoError(t, r.RotateNow())
+	assert.Equal(t, "test-2017-11-06.log", r.CurrentFile(), "RotateNow should rotate")
+	assert.Equal(t, RotationEvent{Old: "test-2017-11-05.log", New: "test-2017-11-06.log", Time: now}, <-events)
+	r.Close()
+}
+
+func TestRolloutOnRotate(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.UTC)
+	var opened []string
+	var r *Rollout
+	r = New(Options{
+		Template:   "test-{{.Time}}.log",
+		BufferFunc: NewMockBuffer,
+		Clock:      func() time.Time { return now },
+		OnRotate: func(newPath string, at time.Time) {
+			// Outside the lock, so reading the Rollout doesn't deadlock.
+			assert.Equal(t, newPath, r.CurrentFile())
+			opened = append(opened, newPath+" "+at.Format("2006-01-02"))
+		},
+	})
+
+	r.Write([]byte("day 5"))
+	r.Write([]byte("day 5"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6"))
+	r.Close()
+	assert.Equal(t, []string{"test-2017-11-05.log 2017-11-05", "test-2017-11-06.log 2017-11-06"}, opened,
+		"every opened destination should be reported")
+}
+
+func TestRolloutSharded(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewSharded(Options{
+		Root:     root,
+		Template: "test-{{.Shard}}.log",
+		Shards:   3,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, s.Shards(), 3)
+
+	for i := 0; i < 6; i++ {
+		s.Write([]byte(strconv.Itoa(i)))
+	}
+	assert.NoError(t, s.Close())
+	for i, want := range []string{"03", "14", "25"} {
+		content, err := os.ReadFile(filepath.Join(root, "test-"+strconv.Itoa(i)+".log"))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(content), "writes should be spread round-robin")
+	}
+	assert.Equal(t, int64(6), s.Stats().BytesWritten, "stats should be summed over shards")
+
+	s, err = NewSharded(Options{
+		Root:     root,
+		Template: "link-{{.Shard}}.log",
+		Shards:   2,
+		Symlink:  "current.log",
+	})
+	assert.NoError(t, err)
+	s.Write([]byte("0"))
+	s.Write([]byte("1"))
+	assert.NoError(t, s.Close())
+	for i := 0; i < 2; i++ {
+		target, err := os.Readlink(filepath.Join(root, "current."+strconv.Itoa(i)+".log"))
+		assert.NoError(t, err, "each shard should have its own link")
+		assert.Equal(t, "link-"+strconv.Itoa(i)+".log", target)
+	}
+
+	_, err = NewSharded(Options{Root: root, Template: "test.log", Shards: 2})
+	assert.Error(t, err, "shards writing the same destination should be rejected")
+	_, err = NewSharded(Options{Root: root})
+	assert.Error(t, err, "Shards should be required")
+}
+
+func TestRolloutTransform(t *testing.T) {
+	secret := regexp.MustCompile(`password=\S+`)
+	var b bytes.Buffer
+	r := New(Options{
+		BufferFunc:    NewWriterBuffer(&b),
+		EnsureNewline: true,
+		Transform: func(p []byte) []byte {
+			if bytes.HasPrefix(p, []byte("debug")) {
+				return nil
+			}
+			return secret.ReplaceAll(p, []byte("password=***"))
+		},
+	})
+
+	n, err := r.Write([]byte("login password=hunter2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 22, n, "length of the original write should be reported")
+	n, err = r.Write([]byte("debug details"))
+	assert.NoError(t, err)
+	assert.Equal(t, 13, n, "dropped write should be reported written")
+	r.Write([]byte("logout"))
+	r.Close()
+	assert.Equal(t, "login password=***\nlogout\n", b.String(), "data should be transformed before the newline is appended")
+}
+
+func TestUserAgent(t *testing.T) {
+	assert.True(t, strings.HasPrefix(UserAgent(), "rollout/"+Version+" ("), "user agent should carry the version")
+	assert.Contains(t, UserAgent(), runtime.GOOS+"/"+runtime.GOARCH)
+}
+
+func TestRolloutRotateNow(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.{{.Seq}}.log",
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	assert.NoError(t, r.RotateNow(), "rotating before any write should open a destination")
+	r.Write([]byte("1"))
+	assert.NoError(t, r.RotateNow())
+	r.Write([]byte("2"))
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("3"))
+	r.Close()
+	assert.Equal(t, ErrClosed, r.RotateNow(), "closed writer should not rotate")
+
+	cases := map[string]string{
+		"test-2017-11-05.0.log": "1",
+		"test-2017-11-05.1.log": "2",
+		"test-2017-11-06.0.log": "3",
+	}
+	for name, expect := range cases {
+		content, err := os.ReadFile(filepath.Join(root, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(content), "content of %s should match", name)
+	}
+	assert.Equal(t, int64(2), r.Stats().Rotations, "rotations should be counted")
+}
+
+func TestRolloutSanitizeFilename(t *testing.T) {
+	now := time.Date(2017, time.November, 5, 12, 30, 15, 0, time.Local)
+	clock := func() time.Time { return now }
+
+	r := New(Options{Root: "logs", SanitizeFilename: true, Clock: clock})
+	dest, _ := r.destination(now)
+	assert.Equal(t, filepath.Join("logs", "rollout-2017-11-05.log"), dest, "default format should be unaffected")
+
+	r = New(Options{
+		Root:             "logs:root",
+		Template:         `app<{{.Time}}>|?*".log`,
+		TimeFormat:       "2006-01-02T15:04:05",
+		SanitizeFilename: true,
+		Clock:            clock,
+	})
+	dest, _ = r.destination(now)
+	assert.Equal(t, filepath.Join("logs:root", "app_2017-11-05T12-30-15_____.log"), dest, "illegal characters should be replaced")
+
+	root := t.TempDir()
+	r = New(Options{
+		Root:             root,
+		Template:         "{{.Time}}.log",
+		TimeFormat:       "2006-01-02T15:04",
+		SanitizeFilename: true,
+		Rotation:         RotateMinutely,
+		Clock:            clock,
+	})
+	r.Write([]byte("1"))
+	r.Close()
+	files, err := r.destinations()
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, time.Date(2017, time.November, 5, 12, 30, 0, 0, time.Local), files[0].at, "time should be parsed from sanitized name")
+	}
+}
+
+func TestRolloutSeq(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "test-2017-11-05.0.log"), []byte("1234567890"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "test-2017-11-05.1.log"), []byte("12345"), 0644))
+
+	r := New(Options{
+		Root:     root,
+		Template: "test-{{.Time}}.{{.Seq}}.log",
+		MaxSize:  10,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	defer r.Close()
+
+	r.Write([]byte("abc"))
+	assert.Equal(t, 1, r.seq, "full destination from a previous run should be skipped")
+	assert.Equal(t, int64(8), r.buf.size, "size should include existing content")
+
+	r.Write([]byte("abc"))
+	assert.Equal(t, 2, r.seq, "seq should increment when a new destination is created")
+
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("abc"))
+	assert.Equal(t, 0, r.seq, "seq should reset when the period changes")
+	assert.Equal(t, filepath.Join(root, "test-2017-11-06.0.log"), r.buf.dest, "destination should use the reset seq")
+}
+
+func TestRolloutLineIntegrity(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		root := t.TempDir()
+		r := New(Options{
+			Root:     root,
+			Template: "test.log",
+			Async:    async,
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				line := []byte(strings.Repeat(string(rune('a'+i)), 5*1024) + "\n")
+				for j := 0; j < 50; j++ {
+					r.Write(line)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.NoError(t, r.Close())
+
+		content, err := os.ReadFile(filepath.Join(root, "test.log"))
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+		assert.Len(t, lines, 8*50, "every line should be written")
+		for _, line := range lines {
+			if !assert.Equal(t, strings.Repeat(line[:1], 5*1024), line, "line should not interleave (async: %v)", async) {
+				break
+			}
+		}
+	}
+}
+
+func benchmarkRollout(b *testing.B) *Rollout {
+	r := New(Options{
+		Rotation:   RotateDaily,
+		BufferFunc: NewWriterBuffer(io.Discard),
+	})
+	b.Cleanup(func() { r.Close() })
+	return r
+}
+
+func BenchmarkWrite(b *testing.B) {
+	r := benchmarkRollout(b)
+	line := []byte("benchmark log line\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Write(line)
+	}
+}
+
+func BenchmarkWriteRotate(b *testing.B) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := New(Options{
+		Rotation:   RotateSecondly,
+		BufferFunc: NewWriterBuffer(io.Discard),
+		Clock: func() time.Time {
+			// Step into the next period on every call.
+			now = now.Add(time.Second)
+			return now
+		},
+	})
+	b.Cleanup(func() { r.Close() })
+	line := []byte("benchmark log line\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Write(line)
+	}
+}
+
+func BenchmarkWriteParallel(b *testing.B) {
+	r := benchmarkRollout(b)
+	line := []byte("benchmark log line\n")
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.Write(line)
+		}
+	})
 }
@@ -0,0 +1,153 @@
+// Package rollouttest provides an in-memory rollout Buffer to test code writing through Rollout.
+// Every destination gets a MemoryBuffer recorded by a Memory, so tests can inspect what was
+// written to each destination, and whether it was flushed and closed:
+//
+//	m := rollouttest.NewMemory()
+//	w := rollout.New(rollout.Options{BufferFunc: m.BufferFunc})
+//	// ... code under test writes to w ...
+//	w.Close()
+//	content := m.Content("rollout-2017-11-05.log")
+package rollouttest
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/jerray/rollout"
+)
+
+// MemoryBuffer is a thread safe rollout Buffer accumulating data in memory.
+type MemoryBuffer struct {
+	dest string
+
+	mux     sync.Mutex
+	buf     bytes.Buffer
+	flushes int
+	closed  bool
+}
+
+// NewMemoryBuffer creates a MemoryBuffer of dest.
+func NewMemoryBuffer(dest string) *MemoryBuffer {
+	return &MemoryBuffer{dest: dest}
+}
+
+// Write appends p to the buffer. It returns rollout.ErrClosed after Close.
+func (b *MemoryBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.closed {
+		return 0, rollout.ErrClosed
+	}
+	return b.buf.Write(p)
+}
+
+// Flush only counts the number of calls, data is kept in memory.
+func (b *MemoryBuffer) Flush() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.flushes++
+	return nil
+}
+
+// Close marks the buffer closed. Its content stays available.
+func (b *MemoryBuffer) Close() error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.closed = true
+	return nil
+}
+
+// Dest returns the destination of the buffer.
+func (b *MemoryBuffer) Dest() string {
+	return b.dest
+}
+
+// Bytes returns a copy of the data written to the buffer.
+func (b *MemoryBuffer) Bytes() []byte {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// String returns the data written to the buffer as a string.
+func (b *MemoryBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.buf.String()
+}
+
+// Flushes returns the number of times the buffer was flushed.
+func (b *MemoryBuffer) Flushes() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.flushes
+}
+
+// Closed reports whether the buffer was closed.
+func (b *MemoryBuffer) Closed() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	return b.closed
+}
+
+// Memory records the MemoryBuffers created by its BufferFunc.
+type Memory struct {
+	mux     sync.Mutex
+	buffers []*MemoryBuffer
+}
+
+// NewMemory creates an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// BufferFunc is a rollout BufferFunc creating a MemoryBuffer for each destination.
+func (m *Memory) BufferFunc(dest string, size int, interval time.Duration) (rollout.Buffer, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	b := NewMemoryBuffer(dest)
+	m.buffers = append(m.buffers, b)
+	return b, nil
+}
+
+// Buffers returns the buffers created so far, in the order they were opened. A destination
+// reopened, for example by Reopen, has several buffers.
+func (m *Memory) Buffers() []*MemoryBuffer {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	return append([]*MemoryBuffer(nil), m.buffers...)
+}
+
+// Content returns the data written to dest, across all of its buffers.
+func (m *Memory) Content(dest string) string {
+	var content bytes.Buffer
+	for _, b := range m.Buffers() {
+		if b.Dest() == dest {
+			content.WriteString(b.String())
+		}
+	}
+	return content.String()
+}
+
+// Dests returns the distinct destinations written so far, in the order they were first opened.
+func (m *Memory) Dests() []string {
+	var dests []string
+	seen := make(map[string]bool)
+	for _, b := range m.Buffers() {
+		if !seen[b.Dest()] {
+			seen[b.Dest()] = true
+			dests = append(dests, b.Dest())
+		}
+	}
+	return dests
+}
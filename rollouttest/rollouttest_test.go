@@ -0,0 +1,45 @@
+package rollouttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jerray/rollout"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	now := time.Date(2017, time.November, 5, 12, 0, 0, 0, time.Local)
+
+	r := rollout.New(rollout.Options{
+		Template:   "test-{{.Time}}.log",
+		BufferFunc: m.BufferFunc,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+
+	r.Write([]byte("day 5\n"))
+	r.Flush()
+	now = now.Add(24 * time.Hour)
+	r.Write([]byte("day 6\n"))
+	r.Reopen()
+	r.Write([]byte("day 6 again\n"))
+	assert.NoError(t, r.Close())
+
+	assert.Equal(t, []string{"test-2017-11-05.log", "test-2017-11-06.log"}, m.Dests(), "destinations should be recorded in order")
+	assert.Equal(t, "day 5\n", m.Content("test-2017-11-05.log"))
+	assert.Equal(t, "day 6\nday 6 again\n", m.Content("test-2017-11-06.log"), "content of reopened destination should be joined")
+
+	bufs := m.Buffers()
+	assert.Len(t, bufs, 3)
+	assert.Equal(t, 1, bufs[0].Flushes(), "flushes should be counted")
+	for _, b := range bufs {
+		assert.True(t, b.Closed(), "buffers should be closed")
+	}
+
+	_, err := bufs[0].Write([]byte("late"))
+	assert.Equal(t, rollout.ErrClosed, err, "closed buffer should reject writes")
+	assert.Equal(t, "day 5\n", string(bufs[0].Bytes()), "content should stay available after close")
+}
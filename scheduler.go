@@ -0,0 +1,80 @@
+package rollout
+
+import (
+	"sync"
+	"time"
+)
+
+// schedulers are the shared flush schedulers by flush interval.
+var schedulers = struct {
+	mux sync.Mutex
+	m   map[time.Duration]*flushScheduler
+}{m: make(map[time.Duration]*flushScheduler)}
+
+// flushScheduler flushes all file buffers of one interval from a single goroutine and ticker,
+// instead of one of each per buffer. It stops once its last buffer is removed.
+type flushScheduler struct {
+	interval time.Duration
+	bufs     map[*FileBuffer]struct{}
+	done     chan struct{}
+}
+
+// sharedScheduler adds b to the shared scheduler of interval, starting it if needed.
+func sharedScheduler(interval time.Duration, b *FileBuffer) *flushScheduler {
+	schedulers.mux.Lock()
+	defer schedulers.mux.Unlock()
+
+	s, ok := schedulers.m[interval]
+	if !ok {
+		s = &flushScheduler{
+			interval: interval,
+			bufs:     make(map[*FileBuffer]struct{}),
+			done:     make(chan struct{}),
+		}
+		schedulers.m[interval] = s
+		go s.run(newTimeTicker(interval))
+	}
+	s.bufs[b] = struct{}{}
+	return s
+}
+
+// remove stops flushing b. The scheduler stops when no buffer is left.
+func (s *flushScheduler) remove(b *FileBuffer) {
+	schedulers.mux.Lock()
+	defer schedulers.mux.Unlock()
+
+	delete(s.bufs, b)
+	if len(s.bufs) == 0 {
+		delete(schedulers.m, s.interval)
+		close(s.done)
+	}
+}
+
+// run flushes buffers on every tick until the scheduler stops.
+func (s *flushScheduler) run(ticker Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.Chan():
+			s.flush()
+		}
+	}
+}
+
+// flush flushes all buffers. They are flushed outside the scheduler lock, so closing buffers
+// never waits for others to be flushed.
+func (s *flushScheduler) flush() {
+	schedulers.mux.Lock()
+	bufs := make([]*FileBuffer, 0, len(s.bufs))
+	for b := range s.bufs {
+		bufs = append(bufs, b)
+	}
+	schedulers.mux.Unlock()
+
+	for _, b := range bufs {
+		b.flushBuffered()
+	}
+}
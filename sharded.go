@@ -0,0 +1,110 @@
+package rollout
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Sharded spreads writes over Shards independent Rollouts, round-robin, each writing its own
+// destinations. Writes only contend for the lock of one shard, at the cost of the order of writes
+// across shards, which readers restore by merging the shards afterward.
+type Sharded struct {
+	shards []*Rollout
+	next   atomic.Uint64
+}
+
+// NewSharded creates Options.Shards Rollouts from options. The template must use `{{.Shard}}`,
+// the index of the shard starting from 0, so shards write distinct destinations. Retention
+// applies to each shard separately, Keeps destinations are kept per shard. A Symlink gets the
+// index of the shard before its extension, such as current.0.log. Options are validated like
+// NewWithError does.
+func NewSharded(options Options) (*Sharded, error) {
+	if options.Shards <= 0 {
+		return nil, fmt.Errorf("rollout: invalid Shards %d", options.Shards)
+	}
+
+	s := &Sharded{shards: make([]*Rollout, 0, options.Shards)}
+	for i := 0; i < options.Shards; i++ {
+		r, err := NewWithError(options)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		// Nothing is rendered or linked before the first write.
+		r.shard = i
+		if r.symlink != "" {
+			// Each shard links its own current destination.
+			r.symlink = routeDest(r.symlink, strconv.Itoa(i))
+		}
+		s.shards = append(s.shards, r)
+	}
+
+	if len(s.shards) > 1 {
+		now := s.shards[0].clock()
+		first, _ := s.shards[0].Destination(now)
+		second, _ := s.shards[1].Destination(now)
+		if first == second {
+			s.Close()
+			return nil, errors.New("rollout: template must use {{.Shard}} with several Shards")
+		}
+	}
+	return s, nil
+}
+
+// Write writes p to the next shard.
+func (s *Sharded) Write(p []byte) (int, error) {
+	return s.shard().Write(p)
+}
+
+// shard returns the shard taking the next write.
+func (s *Sharded) shard() *Rollout {
+	i := s.next.Add(1) - 1
+	return s.shards[i%uint64(len(s.shards))]
+}
+
+// Shards returns the Rollouts of the shards, for the operations not provided by Sharded.
+func (s *Sharded) Shards() []*Rollout {
+	return s.shards
+}
+
+// Flush flushes all shards, errors are joined.
+func (s *Sharded) Flush() error {
+	return s.each(func(r *Rollout) error { return r.Flush() })
+}
+
+// Sync syncs all shards, errors are joined.
+func (s *Sharded) Sync() error {
+	return s.each(func(r *Rollout) error { return r.Sync() })
+}
+
+// Close closes all shards, errors are joined.
+func (s *Sharded) Close() error {
+	return s.each(func(r *Rollout) error { return r.Close() })
+}
+
+// Stats returns the sum of the counters of all shards.
+func (s *Sharded) Stats() Stats {
+	var total Stats
+	for _, r := range s.shards {
+		stats := r.Stats()
+		total.BytesWritten += stats.BytesWritten
+		total.Flushes += stats.Flushes
+		total.Rotations += stats.Rotations
+		total.WriteErrors += stats.WriteErrors
+		total.Dropped += stats.Dropped
+	}
+	return total
+}
+
+// each calls f for all shards and joins the errors.
+func (s *Sharded) each(f func(r *Rollout) error) error {
+	var errs []error
+	for _, r := range s.shards {
+		if err := f(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
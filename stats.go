@@ -0,0 +1,50 @@
+package rollout
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds counters of a Rollout since it is created.
+type Stats struct {
+	// BytesWritten is the number of bytes written to buffers.
+	BytesWritten int64
+
+	// Flushes is the number of successful flushes, by Flush and Sync calls, and by the interval
+	// flushing of the built-in file buffer.
+	Flushes int64
+
+	// Rotations is the number of times a new buffer replaced the previous one.
+	Rotations int64
+
+	// WriteErrors is the number of writes failed to open a buffer or write to it.
+	WriteErrors int64
+
+	// Dropped is the number of writes discarded by SafeWriter because they failed, or because they
+	// exceeded MaxBytesPerSecond.
+	Dropped int64
+}
+
+// counters are updated atomically, so reading them doesn't need the write lock.
+type counters struct {
+	bytesWritten atomic.Int64
+	flushes      atomic.Int64
+	rotations    atomic.Int64
+	writeErrors  atomic.Int64
+	dropped      atomic.Int64
+}
+
+// Stats returns a snapshot of the counters. It is safe to call concurrently with Write.
+func (r *Rollout) Stats() Stats {
+	return Stats{
+		BytesWritten: r.counters.bytesWritten.Load(),
+		Flushes:      r.counters.flushes.Load(),
+		Rotations:    r.counters.rotations.Load(),
+		WriteErrors:  r.counters.writeErrors.Load(),
+		Dropped:      r.counters.dropped.Load(),
+	}
+}
+
+// countFlush counts a flush done in background by the built-in file buffer.
+func (r *Rollout) countFlush() {
+	r.counters.flushes.Add(1)
+}
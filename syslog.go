@@ -0,0 +1,119 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package rollout
+
+import (
+	"fmt"
+	"log/syslog"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultSyslogPriority = syslog.LOG_USER | syslog.LOG_INFO
+
+var (
+	syslogFacilities = map[string]syslog.Priority{
+		"kern":     syslog.LOG_KERN,
+		"user":     syslog.LOG_USER,
+		"mail":     syslog.LOG_MAIL,
+		"daemon":   syslog.LOG_DAEMON,
+		"auth":     syslog.LOG_AUTH,
+		"syslog":   syslog.LOG_SYSLOG,
+		"lpr":      syslog.LOG_LPR,
+		"news":     syslog.LOG_NEWS,
+		"uucp":     syslog.LOG_UUCP,
+		"cron":     syslog.LOG_CRON,
+		"authpriv": syslog.LOG_AUTHPRIV,
+		"ftp":      syslog.LOG_FTP,
+		"local0":   syslog.LOG_LOCAL0,
+		"local1":   syslog.LOG_LOCAL1,
+		"local2":   syslog.LOG_LOCAL2,
+		"local3":   syslog.LOG_LOCAL3,
+		"local4":   syslog.LOG_LOCAL4,
+		"local5":   syslog.LOG_LOCAL5,
+		"local6":   syslog.LOG_LOCAL6,
+		"local7":   syslog.LOG_LOCAL7,
+	}
+
+	syslogSeverities = map[string]syslog.Priority{
+		"emerg":   syslog.LOG_EMERG,
+		"alert":   syslog.LOG_ALERT,
+		"crit":    syslog.LOG_CRIT,
+		"err":     syslog.LOG_ERR,
+		"warning": syslog.LOG_WARNING,
+		"notice":  syslog.LOG_NOTICE,
+		"info":    syslog.LOG_INFO,
+		"debug":   syslog.LOG_DEBUG,
+	}
+)
+
+// SyslogBuffer is a Buffer sending data to syslog. Every Write is sent as one message, so
+// nothing is buffered and Flush does nothing.
+type SyslogBuffer struct {
+	w *syslog.Writer
+}
+
+// NewSyslogBuffer creates a new SyslogBuffer connected to the local syslog daemon. The base name of
+// dest is used as the tag. If dest has a parent directory, its base name is read as a
+// "facility.severity" priority, such as "local0.info". Default priority is "user.info".
+func NewSyslogBuffer(dest string, size int, interval time.Duration) (Buffer, error) {
+	return newSyslogBuffer("", "", dest)
+}
+
+// SyslogBufferFunc returns a BufferFunc creating SyslogBuffer connected to the syslog daemon at
+// raddr on the specified network. The dest is treated the same way as in NewSyslogBuffer.
+func SyslogBufferFunc(network, raddr string) BufferFunc {
+	return func(dest string, size int, interval time.Duration) (Buffer, error) {
+		return newSyslogBuffer(network, raddr, dest)
+	}
+}
+
+func newSyslogBuffer(network, raddr, dest string) (Buffer, error) {
+	dir, tag := filepath.Split(dest)
+
+	priority := defaultSyslogPriority
+	if dir = filepath.Base(dir); dir != "." && dir != string(filepath.Separator) {
+		p, err := parseSyslogPriority(dir)
+		if err != nil {
+			return nil, err
+		}
+		priority = p
+	}
+
+	w, err := syslog.Dial(network, raddr, priority, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogBuffer{w: w}, nil
+}
+
+// parseSyslogPriority parses a "facility.severity" string into a syslog priority.
+func parseSyslogPriority(s string) (syslog.Priority, error) {
+	parts := strings.SplitN(s, ".", 2)
+	facility, ok := syslogFacilities[parts[0]]
+	if !ok || len(parts) != 2 {
+		return 0, fmt.Errorf("invalid syslog priority %q", s)
+	}
+	severity, ok := syslogSeverities[parts[1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid syslog priority %q", s)
+	}
+	return facility | severity, nil
+}
+
+// Write sends p to syslog as one message.
+func (b *SyslogBuffer) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// Flush does nothing, data is never buffered.
+func (b *SyslogBuffer) Flush() error {
+	return nil
+}
+
+// Close closes the connection to syslog.
+func (b *SyslogBuffer) Close() error {
+	return b.w.Close()
+}
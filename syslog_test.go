@@ -0,0 +1,27 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package rollout
+
+import (
+	"log/syslog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyslogPriority(t *testing.T) {
+	p, err := parseSyslogPriority("local0.info")
+	assert.NoError(t, err)
+	assert.Equal(t, syslog.LOG_LOCAL0|syslog.LOG_INFO, p, "priority should match")
+
+	for _, s := range []string{"local0", "local8.info", "user.verbose", ""} {
+		_, err = parseSyslogPriority(s)
+		assert.Error(t, err, "%q should be invalid", s)
+	}
+}
+
+func TestNewSyslogBufferInvalidPriority(t *testing.T) {
+	_, err := NewSyslogBuffer("/var/log/test", 0, 0)
+	assert.Error(t, err, "parent directory should be read as priority")
+}
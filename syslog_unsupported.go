@@ -0,0 +1,18 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package rollout
+
+import (
+	"time"
+)
+
+// NewSyslogBuffer always returns ErrSyslogUnsupported on this platform.
+func NewSyslogBuffer(dest string, size int, interval time.Duration) (Buffer, error) {
+	return nil, ErrSyslogUnsupported
+}
+
+// SyslogBufferFunc returns a BufferFunc always returning ErrSyslogUnsupported on this platform.
+func SyslogBufferFunc(network, raddr string) BufferFunc {
+	return NewSyslogBuffer
+}
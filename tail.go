@@ -0,0 +1,96 @@
+package rollout
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// tailChunkSize is the size of chunks read backwards from the end of the destination by Tail.
+const tailChunkSize = 4096
+
+var (
+	// ErrTailUnsupported is returned by Tail when the current buffer doesn't write to a file.
+	ErrTailUnsupported = errors.New("tail is only supported by the file buffer")
+
+	// ErrTailMoved is returned by Tail when the file of the current buffer was moved or deleted,
+	// so it can't be read back by name.
+	ErrTailMoved = errors.New("file of the buffer was moved or deleted")
+)
+
+// Tail flushes the current buffer, then returns the last n lines of its file. It returns nothing
+// if no buffer is opened yet, ErrTailUnsupported for buffers other than FileBuffer, and
+// ErrTailMoved if the file was moved or deleted since it was opened.
+func (r *Rollout) Tail(n int) ([]byte, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if r.closed {
+		return nil, ErrClosed
+	}
+	if r.buf == nil || n <= 0 {
+		return nil, nil
+	}
+	fb, ok := r.buf.Buffer.(*FileBuffer)
+	if !ok {
+		return nil, ErrTailUnsupported
+	}
+	if err := r.waitInflight(); err != nil {
+		return nil, err
+	}
+	if err := r.buf.Flush(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fb.Name())
+	if os.IsNotExist(err) {
+		return nil, ErrTailMoved
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The name may refer to another file by now, so what was opened is checked, not the name.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fb.is(info) {
+		return nil, ErrTailMoved
+	}
+	return readTail(f, info.Size(), n)
+}
+
+// readTail reads the last n lines of f, which is size bytes long, reading backwards in chunks so
+// only the tail is loaded. A final line without newline counts as a line.
+func readTail(f *os.File, size int64, n int) ([]byte, error) {
+	var tail []byte
+	for offset := size; offset > 0; {
+		chunkSize := int64(tailChunkSize)
+		if offset < chunkSize {
+			chunkSize = offset
+		}
+		offset -= chunkSize
+
+		chunk := make([]byte, chunkSize, int64(len(tail))+chunkSize)
+		if _, err := f.ReadAt(chunk, offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(chunk, tail...)
+
+		// The newline ending the last line doesn't start another one.
+		lines := tail
+		if len(tail) > 0 && tail[len(tail)-1] == '\n' {
+			lines = tail[:len(tail)-1]
+		}
+		if bytes.Count(lines, []byte{'\n'}) >= n {
+			for i := 0; i < n; i++ {
+				lines = lines[:bytes.LastIndexByte(lines, '\n')]
+			}
+			return tail[len(lines)+1:], nil
+		}
+	}
+	return tail, nil
+}
@@ -0,0 +1,92 @@
+package rollout
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrWriteTimeout is returned by Write when the buffer doesn't complete a write within
+// WriteTimeout, or is still busy with a write which timed out before.
+var ErrWriteTimeout = errors.New("write to buffer timed out")
+
+// bufferWrite writes data to the current buffer. With WriteTimeout set, the write runs in a
+// goroutine and ErrWriteTimeout is returned if it doesn't complete in time. The write left in
+// flight is awaited by the next operation on the buffer. The caller must hold the write lock.
+func (r *Rollout) bufferWrite(data []byte) (int, error) {
+	if r.writeTimeout <= 0 {
+		return r.buf.Write(data)
+	}
+
+	// The caller may reuse p once Write returns, the write in flight needs its own copy.
+	p := append([]byte(nil), data...)
+	buf := r.buf.Buffer
+	done := make(chan struct{})
+	var n int
+	var err error
+	go func() {
+		defer close(done)
+		n, err = buf.Write(p)
+	}()
+
+	timer := time.NewTimer(r.writeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return n, err
+	case <-timer.C:
+		r.inflight = done
+		return 0, ErrWriteTimeout
+	}
+}
+
+// awaitInflight waits up to WriteTimeout for a write which timed out before to complete, so the
+// buffer is never written, rotated or closed during it. The caller must hold the write lock.
+func (r *Rollout) awaitInflight() error {
+	if r.inflight == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(r.writeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-r.inflight:
+		r.inflight = nil
+		return nil
+	case <-timer.C:
+		return ErrWriteTimeout
+	}
+}
+
+// waitInflight waits like awaitInflight for callers holding only the read lock, such as Flush,
+// leaving r.inflight for the next writer to clear.
+func (r *Rollout) waitInflight() error {
+	if r.inflight == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(r.writeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-r.inflight:
+		return nil
+	case <-timer.C:
+		return ErrWriteTimeout
+	}
+}
+
+// busy reports whether a write which timed out is still running, so the buffer must be left
+// alone. The caller must hold the lock.
+func (r *Rollout) busy() bool {
+	if r.inflight == nil {
+		return false
+	}
+	select {
+	case <-r.inflight:
+		return false
+	default:
+		return true
+	}
+}
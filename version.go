@@ -0,0 +1,12 @@
+package rollout
+
+import "runtime"
+
+// Version is the version of the package.
+const Version = "0.1.0"
+
+// UserAgent returns the string identifying this package to remote sinks, for custom network
+// buffers to send, for example as the User-Agent header, like "rollout/0.1.0 (go1.20; linux/amd64)".
+func UserAgent() string {
+	return "rollout/" + Version + " (" + runtime.Version() + "; " + runtime.GOOS + "/" + runtime.GOARCH + ")"
+}